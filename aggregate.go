@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const logsAggregateV2Path = "/api/v2/logs/analytics/aggregate"
+
+// Name of the count in the aggregate requests and in the output of 'doglog count'.
+const countCompute = "c0"
+const countColumn = "count"
+
+// Body of a v2 logs aggregate request, counting the matching messages per group.
+type logsAggregateRequestV2 struct {
+	Compute []logsComputeV2    `json:"compute"`
+	Filter  logsSearchFilterV2 `json:"filter"`
+	GroupBy []logsGroupByV2    `json:"group_by"`
+	Page    *logsCursorPageV2  `json:"page,omitempty"`
+}
+
+type logsComputeV2 struct {
+	Aggregation string `json:"aggregation"`
+	Type        string `json:"type"`
+}
+
+// A facet to group by, with the most frequent values first.
+type logsGroupByV2 struct {
+	Facet string          `json:"facet"`
+	Limit int             `json:"limit"`
+	Sort  logsGroupSortV2 `json:"sort"`
+}
+
+type logsGroupSortV2 struct {
+	Aggregation string `json:"aggregation"`
+	Order       string `json:"order"`
+	Type        string `json:"type"`
+}
+
+type logsCursorPageV2 struct {
+	Cursor string `json:"cursor"`
+}
+
+// Response of the aggregate API. Every bucket holds the facet values of a group and its count.
+type logsAggregateResponseV2 struct {
+	Data struct {
+		Buckets []struct {
+			By       map[string]interface{} `json:"by"`
+			Computes map[string]interface{} `json:"computes"`
+		} `json:"buckets"`
+	} `json:"data"`
+	Meta struct {
+		Page struct {
+			After string `json:"after"`
+		} `json:"page"`
+	} `json:"meta"`
+}
+
+// countGroup is the number of matching messages with a combination of facet values.
+type countGroup struct {
+	values map[string]interface{} // facet -> value, typed as in the attributes
+	count  int64
+}
+
+// Compute the body of an aggregate request. The limit is the number of values kept per facet.
+func aggregateAPIBodyV2(search searchRequest, facets []string, limit int) string {
+	request := logsAggregateRequestV2{
+		Compute: []logsComputeV2{{Aggregation: "count", Type: "total"}},
+		Filter:  searchFilterV2(search),
+	}
+	for _, facet := range facets {
+		request.GroupBy = append(request.GroupBy, logsGroupByV2{
+			Facet: facet,
+			Limit: limit,
+			Sort:  logsGroupSortV2{Aggregation: "count", Order: sortDesc, Type: "measure"},
+		})
+	}
+	if len(search.cursor) > 0 {
+		request.Page = &logsCursorPageV2{Cursor: search.cursor}
+	}
+
+	buf, _ := json.Marshal(request)
+	return string(buf)
+}
+
+// Count the messages that match the search per combination of facet values, following the pages of the aggregate
+// API. Facets are named as in Datadog: 'service', 'host', 'status' or '@' followed by the attribute path. The
+// --facet-limit values with the largest counts are kept per facet.
+// returns: the groups, largest count first.
+func fetchCounts(opts *options, search searchRequest, facets []string) ([]countGroup, error) {
+	var groups []countGroup
+	for {
+		jsonBytes, err := callDatadog(opts, http.MethodPost, logsAggregateV2Path, aggregateAPIBodyV2(search, facets, opts.facetLimit))
+		if err != nil {
+			return nil, err
+		}
+		var response logsAggregateResponseV2
+		decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&response); err != nil || response.Data.Buckets == nil {
+			return nil, newMalformedError("no 'buckets' list")
+		}
+		for _, bucket := range response.Data.Buckets {
+			group := countGroup{values: make(map[string]interface{})}
+			for _, facet := range facets {
+				group.values[facet] = typedJSONValue(bucket.By[facet])
+			}
+			switch count := typedJSONValue(bucket.Computes[countCompute]).(type) {
+			case int64:
+				group.count = count
+			case float64:
+				group.count = int64(count)
+			}
+			groups = append(groups, group)
+		}
+		if len(response.Meta.Page.After) == 0 {
+			break
+		}
+		search.cursor = response.Meta.Page.After
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		return groupKey(groups[i], facets) < groupKey(groups[j], facets)
+	})
+	return groups, nil
+}
+
+// Format the value of a facet for the table and csv outputs. Missing values are empty.
+func facetValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// Join the facet values of a group, to order groups with the same count.
+func groupKey(group countGroup, facets []string) string {
+	values := make([]string, len(facets))
+	for i, facet := range facets {
+		values[i] = facetValue(group.values[facet])
+	}
+	return strings.Join(values, "\x00")
+}
@@ -1,186 +1,222 @@
 package main
 
 import (
+	"./config"
+	"encoding/json"
+	"errors"
 	"fmt"
-	lru "github.com/hashicorp/golang-lru"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/buger/jsonparser"
 )
 
 const jsonAcceptType = "application/json"
+const jsonContentType = "application/json"
+
+// Datadog sites and the domains that serve them. The API host is the domain prefixed with 'api.'.
+var datadogSites = map[string]string{
+	"us1": "datadoghq.com",
+	"eu":  "datadoghq.eu",
+	"eu1": "datadoghq.eu",
+	"us3": "us3.datadoghq.com",
+	"us5": "us5.datadoghq.com",
+	"ap1": "ap1.datadoghq.com",
+	"ap2": "ap2.datadoghq.com",
+	"gov": "ddog-gov.com",
+}
+
+// Authentication headers.
+const apiKeyHeader = "DD-API-KEY"
+const applicationKeyHeader = "DD-APPLICATION-KEY"
+
+// Replaces key values in diagnostic output.
+const redacted = "<redacted>"
 
 const datadogOutputTimeFormat = "2006-01-02T15:04:05.000Z"
-const datadogInputTimeFormat = "2006-01-02 15:04:05"
 
 // JSON fields returned from Datadog call.
-const logsField = "logs"
-const statusField = "status"
 const idField = "id"
-const contentField = "content"
 const tagsField = "tags"
-const nextLogIdField = "nextLogId"
-
-// Datadog status values
-const statusOk = "ok"     // More messages.
-const statusDone = "done" // No more messages.
-
-const datadogUri = "https://api.datadoghq.com/api/v1/logs-queries/list?api_key=%s&application_key=%s"
-
-// Stores recent log messages. This is used when tailing to prevent an overlap of messages output.
-var msgCache, _ = lru.New(1024)
 
 // Simple structure to hold a single log message.
 type logMessage struct {
 	id        string
 	timestamp time.Time
-	fields    map[string]string
+	fields    map[string]string      // flattened string values, e.g., http_status_code, plus the computed fields
+	attrs     map[string]interface{} // attributes as received, nested and typed, e.g., http.status_code
 	tags      []string
+	raw       []byte // the event as returned by Datadog
 }
 
-// Fetch all messages that match the settings in the options.
-func fetchMessages(opts *options, startingId string) (result []logMessage, nextId string) {
-	api := messageAPIURI(opts, startingId)
-	jsonBytes := callDatadog(opts, api, jsonAcceptType)
-
-	// Get the messages from the returned JSON.
-	messages := getJSONArray(jsonBytes, logsField)
-	_, valueType, err := getJSONValue(jsonBytes, nextLogIdField)
-	if err != nil || valueType == jsonparser.Null {
-		nextId = ""
-	} else {
-		nextId = getJSONString(jsonBytes, nextLogIdField)
-	}
-
-	status := getJSONString(jsonBytes, statusField)
-	if status == statusOk || status == statusDone {
-		return extractMessages(status, nextId, messages, opts)
+// Fetch a page of messages that match the search. The API version used is selected by the 'api-version' key in the
+// configuration file.
+// returns: the messages, in the order of the search, and the cursor of the next page, empty when there are no more
+// pages.
+func fetchMessages(opts *options, search searchRequest) (result []logMessage, nextId string, err error) {
+	if opts.serverConfig.ApiVersion() == config.ApiVersion1 {
+		result, nextId, err = fetchMessagesV1(opts, search)
 	} else {
-		_, _ = fmt.Fprintf(os.Stderr, "Error while retrieving logs, status was: %s", status)
-		return []logMessage{}, ""
+		result, nextId, err = fetchMessagesV2(opts, search)
 	}
+	return sortMessages(result, search.sort), nextId, err
 }
 
-func extractMessages(status string, nextId string, messages []byte, opts *options) (result []logMessage, nextIdResult string) {
-	if status == statusDone {
-		nextId = ""
+// Build a single log message from the id, field map, attribute tree and tags pulled out of a Datadog response.
+// returns: false if the message has no valid timestamp.
+func newLogMessage(id string, msg map[string]string, attrs map[string]interface{}, tags []string) (logMessage, bool) {
+	tsStr := msg[timestampField] // 2019-10-03T13:22:52.882Z
+
+	ts, err := time.Parse(datadogOutputTimeFormat, tsStr)
+	if err != nil {
+		ts, err = time.Parse(time.RFC3339Nano, tsStr)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid json timestamp: %s - %s\n", tsStr, err.Error())
+		return logMessage{}, false
 	}
-	_, _ = jsonparser.ArrayEach(messages, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		id := getJSONString(value, idField)
-		msg := getJSONSimpleMap(value, contentField)
-		tags := getJSONArrayOfStrings(value, contentField, tagsField)
-		tsStr := msg[timestampField] // 2019-10-03T13:22:52.882Z
+	return logMessage{
+		id:        id,
+		timestamp: ts,
+		fields:    msg,
+		attrs:     attrs,
+		tags:      tags,
+	}, true
+}
 
-		ts, err := time.Parse(datadogOutputTimeFormat, tsStr)
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Invalid json timestamp: %s - %s\n", tsStr, err.Error())
-		}
-		if err == nil {
-			msgObj := logMessage{
-				id:        id,
-				timestamp: ts,
-				fields:    msg,
-				tags:      tags,
-			}
-			result = append(result, msgObj)
+// Sort a page of messages oldest first (sortAsc) or newest first (sortDesc). Messages with the same timestamp keep
+// the order Datadog returned them in.
+func sortMessages(result []logMessage, order string) []logMessage {
+	sort.SliceStable(result, func(i, j int) bool {
+		if order == sortDesc {
+			return result[i].timestamp.After(result[j].timestamp)
 		}
-	})
-	sort.Slice(result, func(i, j int) bool {
 		return result[i].timestamp.Before(result[j].timestamp)
 	})
-	if opts.limit > 0 {
-		var filteredMessages []logMessage
-		for _, log := range result {
-			if !msgCache.Contains(log.id) {
-				filteredMessages = append(filteredMessages, log)
-				msgCache.Add(log.id, true)
-			}
-		}
-		result = filteredMessages
-	}
-	return result, nextId
+	return result
 }
 
-// Compute the API Uri to call. Determined by examining the command-line options.
-func messageAPIURI(opts *options, nextId string) (uri string) {
-	api := "{\"query\": \"%QUERY%\",\"time\": {\"from\": \"%START%\", \"to\": \"%END%\"}, \"sort\": \"desc\", \"limit\": %LIMIT%, \"startAt\": %STARTAT%}"
-	if opts.startDate == nil || opts.endDate == nil {
-		// uri = fmt.Sprintf(relativeSearch, strconv.Itoa(opts.timeRange))
-		api = strings.Replace(api, "%START%", "now - "+strconv.Itoa(opts.timeRange)+"s", 1)
-		api = strings.Replace(api, "%END%", "now", 1)
-	} else {
-		api = strings.Replace(api, "%START%", (*opts.startDate).Format(datadogInputTimeFormat), 1)
-		api = strings.Replace(api, "%END%", (*opts.endDate).Format(datadogInputTimeFormat), 1)
+// Compute the base URI of the Datadog API. An explicit base URL wins over the site, which can be either a short site
+// name (us1, eu, us3, us5, ap1, ap2, gov) or the site domain (e.g., datadoghq.eu). Defaults to the US1 site.
+func datadogBaseUri(site string, baseUrl string) (string, error) {
+	if len(baseUrl) > 0 {
+		return strings.TrimRight(baseUrl, "/"), nil
 	}
-	if opts.limit > 0 {
-		api = strings.Replace(api, "%LIMIT%", strconv.Itoa(opts.limit), 1)
-	} else {
-		api = strings.Replace(api, "%LIMIT%", "300", 1)
-	}
-	if len(opts.query) > 0 {
-		api = strings.Replace(api, "%QUERY%", opts.query, 1)
-	} else {
-		api = strings.Replace(api, "%QUERY%", "*", 1)
+	site = strings.ToLower(strings.TrimSpace(site))
+	if len(site) == 0 {
+		site = "us1"
 	}
-	if len(nextId) > 0 {
-		api = strings.Replace(api, "%STARTAT%", nextId, 1)
-	} else {
-		api = strings.Replace(api, "%STARTAT%", "null", 1)
+	domain, ok := datadogSites[site]
+	if !ok {
+		if !strings.Contains(site, ".") {
+			return "", fmt.Errorf("unknown Datadog site: %s", site)
+		}
+		domain = strings.TrimPrefix(site, "api.")
 	}
-
-	return api
+	return "https://api." + domain, nil
 }
 
-// Common entry-point for calls to Datadog.
-func callDatadog(opts *options, api string, acceptType string) []byte {
+// Common entry-point for calls to Datadog. The keys are sent as headers so they never show up in a URI. GET calls
+// have no body.
+func callDatadog(opts *options, method string, path string, api string) ([]byte, error) {
 	cfg := opts.serverConfig
 
-	apiKey := cfg.ApiKey()
-	applicationKey := cfg.ApplicationKey()
-
-	if acceptType == jsonAcceptType {
-		uri := fmt.Sprintf(datadogUri, apiKey, applicationKey)
-		return readBytes(uri, api)
+	apiKey, err := cfg.ApiKey()
+	if err != nil {
+		return nil, err
+	}
+	applicationKey, err := cfg.ApplicationKey()
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		apiKeyHeader:         apiKey,
+		applicationKeyHeader: applicationKey,
 	}
 
-	return nil
+	// Rate limited calls are retried once the budget resets, unless that takes too long.
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		jsonBytes, err := readBytes(opts.client, method, opts.apiUri+path, api, headers)
+		reportRateLimit(opts)
+		var e *apiError
+		if err == nil || !errors.As(err, &e) || e.kind != rateLimitError || attempt >= maxRateLimitRetries {
+			return jsonBytes, err
+		}
+		wait := retryDelay(attempt, e.budget)
+		if waited+wait > maxRateLimitWait {
+			return jsonBytes, err
+		}
+		waited += wait
+		_, _ = fmt.Fprintf(os.Stderr, "Rate limited, retrying in %ds\n", int(math.Ceil(wait.Seconds())))
+		retrySleep(wait)
+	}
 }
 
-// Return the raw bytes sent by Datadog.
-func readBytes(uri string, body string) []byte {
-	return fetch(uri, body, jsonAcceptType)
+// Return the raw bytes sent by Datadog. The bytes are guaranteed to be valid JSON.
+func readBytes(client *http.Client, method string, uri string, body string, headers map[string]string) ([]byte, error) {
+	jsonBytes, err := fetch(client, method, uri, body, jsonAcceptType, headers)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(jsonBytes) {
+		return nil, newMalformedError("invalid JSON")
+	}
+	return jsonBytes, nil
 }
 
-// Low-level HTTP call to Datadog.
-func fetch(uri string, api string, acceptType string) []byte {
-	var client *http.Client
-	client = &http.Client{}
+// Replace the values of the authentication headers in a diagnostic message.
+func redactKeys(text string, headers map[string]string) string {
+	for _, name := range []string{apiKeyHeader, applicationKeyHeader} {
+		if key := headers[name]; len(key) > 0 {
+			text = strings.ReplaceAll(text, key, redacted)
+		}
+	}
+	return text
+}
 
-	req, err := http.NewRequest("POST", uri, strings.NewReader(api))
+// Low-level HTTP call to Datadog. Any non-2xx response is returned as an *apiError.
+func fetch(client *http.Client, method string, uri string, api string, acceptType string, headers map[string]string) ([]byte, error) {
+	var reader io.Reader
+	if len(api) > 0 {
+		reader = strings.NewReader(api)
+	}
+	req, err := http.NewRequest(method, uri, reader)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Request is malformed: %s\n", err.Error())
-		os.Exit(1)
+		return nil, &apiError{kind: requestError, message: "Request is malformed", err: errors.New(redactKeys(err.Error(), headers))}
 	}
 	req.Header.Add("Accept", acceptType)
+	if reader != nil {
+		req.Header.Add("Content-Type", jsonContentType)
+	}
+	for name, value := range headers {
+		req.Header.Add(name, value)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Unable to connect to Datadog: %s\n", err.Error())
-		os.Exit(1)
+		return nil, &apiError{kind: networkError, message: "Unable to connect to Datadog", err: errors.New(redactKeys(err.Error(), headers))}
 	}
 	//noinspection GoUnhandledErrorResult
 	defer resp.Body.Close()
 
+	budget := parseRateLimit(resp.Header)
+	if budget.known {
+		lastRateLimit = budget
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Unable to read content from Datadog: %s\n", err.Error())
-		os.Exit(1)
+		return nil, &apiError{kind: networkError, status: resp.StatusCode, message: "Unable to read content from Datadog", err: errors.New(redactKeys(err.Error(), headers))}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := newStatusError(resp.StatusCode, body)
+		e.budget = budget
+		return nil, e
 	}
 
-	return body
+	return body, nil
 }
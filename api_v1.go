@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/buger/jsonparser"
+)
+
+// Deprecated v1 log list endpoint. Only used when the configuration selects 'api-version: v1'.
+const logsListV1Path = "/api/v1/logs-queries/list"
+
+// Absolute times are sent with their time zone, so local times (e.g., from --start) and the UTC message timestamps
+// used when tailing are both understood. The milliseconds are kept, the tail windows start at a message timestamp.
+const datadogInputTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// JSON fields returned from the v1 Datadog call.
+const logsField = "logs"
+const statusField = "status"
+const contentField = "content"
+const nextLogIdField = "nextLogId"
+
+// Datadog status values
+const statusOk = "ok"     // More messages.
+const statusDone = "done" // No more messages.
+
+// Request body of a v1 log list call.
+type logsListRequestV1 struct {
+	Query   string         `json:"query"`
+	Time    logsListTimeV1 `json:"time"`
+	Sort    string         `json:"sort"`
+	Limit   int            `json:"limit"`
+	StartAt *string        `json:"startAt"`
+	Index   string         `json:"index,omitempty"`
+}
+
+// Time window of a v1 log list call.
+type logsListTimeV1 struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Fetch all messages that match the settings in the options using the v1 log list API.
+func fetchMessagesV1(opts *options, search searchRequest) (result []logMessage, nextId string, err error) {
+	api := messageAPIBodyV1(search)
+	jsonBytes, err := callDatadog(opts, http.MethodPost, logsListV1Path, api)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Get the messages from the returned JSON.
+	messages, dataType, err := getJSONValue(jsonBytes, logsField)
+	if err != nil || dataType != jsonparser.Array {
+		return nil, "", newMalformedError("no '" + logsField + "' list")
+	}
+	_, valueType, err := getJSONValue(jsonBytes, nextLogIdField)
+	if err != nil || valueType == jsonparser.Null {
+		nextId = ""
+	} else {
+		nextId = getJSONString(jsonBytes, nextLogIdField)
+	}
+
+	status := getJSONString(jsonBytes, statusField)
+	if status == statusOk || status == statusDone {
+		result, nextId = extractMessages(status, nextId, messages)
+		return result, nextId, nil
+	}
+	return nil, "", &apiError{kind: serverError, message: "Error while retrieving logs, status was: " + status}
+}
+
+func extractMessages(status string, nextId string, messages []byte) (result []logMessage, nextIdResult string) {
+	if status == statusDone {
+		nextId = ""
+	}
+	_, _ = jsonparser.ArrayEach(messages, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		id := getJSONString(value, idField)
+		msg := getJSONSimpleMap(value, contentField)
+		tags := getJSONArrayOfStrings(value, contentField, tagsField)
+		if msgObj, ok := newLogMessage(id, msg, getJSONTree(value, contentField), tags); ok {
+			msgObj.raw = compactJSON(value)
+			result = append(result, msgObj)
+		}
+	})
+	return result, nextId
+}
+
+// Compute the body of the v1 log list request. The v1 API only searches a single index.
+func messageAPIBodyV1(search searchRequest) string {
+	request := logsListRequestV1{
+		Query: search.query,
+		Time:  logsListTimeV1{From: "now - " + strconv.Itoa(search.timeRange) + "s", To: "now"},
+		Sort:  search.sort,
+		Limit: search.limit,
+	}
+	if !search.relative() {
+		request.Time.From = search.start.Format(datadogInputTimeFormat)
+		request.Time.To = search.end.Format(datadogInputTimeFormat)
+	}
+	if len(search.cursor) > 0 {
+		request.StartAt = &search.cursor
+	}
+	if len(search.indexes) > 0 {
+		request.Index = search.indexes[0]
+	}
+
+	buf, _ := json.Marshal(request)
+	return string(buf)
+}
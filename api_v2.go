@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/buger/jsonparser"
+)
+
+// Logs Search v2 endpoint. This is the default API.
+const logsSearchV2Path = "/api/v2/logs/events/search"
+
+// JSON fields returned from the v2 Datadog call.
+const dataField = "data"
+const attributesField = "attributes"
+const metaField = "meta"
+const pageField = "page"
+const afterField = "after"
+const errorsField = "errors"
+
+// Sort values understood by the v2 API.
+const sortAscV2 = "timestamp"
+const sortDescV2 = "-timestamp"
+
+// Request body of a v2 log search.
+type logsSearchRequestV2 struct {
+	Filter logsSearchFilterV2 `json:"filter"`
+	Sort   string             `json:"sort"`
+	Page   logsSearchPageV2   `json:"page"`
+}
+
+// Query and time window of a v2 log search.
+type logsSearchFilterV2 struct {
+	Query   string   `json:"query"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Indexes []string `json:"indexes,omitempty"`
+}
+
+// Page size and cursor of a v2 log search.
+type logsSearchPageV2 struct {
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Fetch all messages that match the search using the v2 log search API.
+func fetchMessagesV2(opts *options, search searchRequest) (result []logMessage, nextCursor string, err error) {
+	api := messageAPIBodyV2(search)
+	jsonBytes, err := callDatadog(opts, http.MethodPost, logsSearchV2Path, api)
+	if err != nil {
+		return nil, "", err
+	}
+
+	messages, dataType, err := getJSONValue(jsonBytes, dataField)
+	if err != nil || dataType != jsonparser.Array {
+		return nil, "", newMalformedError("no '" + dataField + "' list")
+	}
+
+	_, valueType, err := getJSONValue(jsonBytes, metaField, pageField, afterField)
+	if err != nil || valueType != jsonparser.String {
+		nextCursor = ""
+	} else {
+		nextCursor = getJSONString(jsonBytes, metaField, pageField, afterField)
+	}
+
+	return extractMessagesV2(messages), nextCursor, nil
+}
+
+// Convert the 'data' array of a v2 response into log messages. Each event holds the reserved fields (timestamp,
+// host, service, message, status, tags) under 'attributes' and the custom fields one level deeper, under
+// 'attributes.attributes'.
+func extractMessagesV2(messages []byte) (result []logMessage) {
+	_, _ = jsonparser.ArrayEach(messages, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		id := getJSONString(value, idField)
+		msg := getJSONSimpleMap(value, attributesField)
+		tags := getJSONArrayOfStrings(value, attributesField, tagsField)
+		// A custom 'timestamp' attribute must not hide the reserved one.
+		if ts, err := jsonparser.GetString(value, attributesField, timestampField); err == nil {
+			msg[timestampField] = ts
+		}
+		if msgObj, ok := newLogMessage(id, msg, getJSONTree(value, attributesField), tags); ok {
+			msgObj.raw = compactJSON(value)
+			result = append(result, msgObj)
+		}
+	})
+	return result
+}
+
+// Compute the body of the v2 search request.
+func messageAPIBodyV2(search searchRequest) string {
+	request := logsSearchRequestV2{
+		Filter: searchFilterV2(search),
+		Sort:   sortDescV2,
+		Page:   logsSearchPageV2{Limit: search.limit, Cursor: search.cursor},
+	}
+	if search.sort == sortAsc {
+		request.Sort = sortAscV2
+	}
+
+	buf, _ := json.Marshal(request)
+	return string(buf)
+}
+
+// Compute the filter of a v2 request: query, time range and indexes. Shared by the search and aggregate APIs.
+func searchFilterV2(search searchRequest) logsSearchFilterV2 {
+	filter := logsSearchFilterV2{
+		Query:   search.query,
+		From:    "now-" + strconv.Itoa(search.timeRange) + "s",
+		To:      "now",
+		Indexes: search.indexes,
+	}
+	if !search.relative() {
+		filter.From = search.start.Format(datadogInputTimeFormat)
+		filter.To = search.end.Format(datadogInputTimeFormat)
+	}
+	return filter
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/akamensky/argparse"
 	"github.com/araddon/dateparse"
+	"golang.org/x/term"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -17,46 +19,121 @@ import (
 // DefaultLimit is the value used when no limit is provided by the user
 const DefaultLimit = 300
 
+// DefaultFacetLimit is the number of values kept per facet by 'doglog count' when no facet limit is provided by the user
+const DefaultFacetLimit = 10
+
 // DefaultRange is the value used when no range is provided by the user
 const DefaultRange = "2h"
 
+// DefaultTailOverlap is the value used when no tail overlap is provided by the user
+const DefaultTailOverlap = "30s"
+
 // DefaultConfigPath is the default location of the configuration path.
 const DefaultConfigPath = "~/.doglog"
 
+// SiteEnv is the environment variable that selects the Datadog site when no --site is provided
+const SiteEnv = "DD_SITE"
+
+// ProfileEnv is the environment variable that selects the config profile when no --profile is provided
+const ProfileEnv = "DOGLOG_PROFILE"
+
+// Environment variables of the color policy, see useColors
+const NoColorEnv = "NO_COLOR"
+const ForceColorEnv = "FORCE_COLOR"
+const CliColorEnv = "CLICOLOR"
+
+// Values of --color.
+const colorAuto = "auto"
+const colorAlways = "always"
+const colorNever = "never"
+
+// Commands selected by the first command-line arguments. Without one, doglog searches and tails logs.
+const configCommand = "config"
+const checkSubcommand = "check"
+const indexesCommand = "indexes"
+const countCommand = "count"
+
 // options structure stores the command-line options and values.
 type options struct {
 	service      string
 	query        string
 	limit        int
+	maxResults   int
+	fromStart    bool // output the first maxResults messages instead of the last ones
+	sort         string
 	tail         bool
+	tailOverlap  int // seconds each tail poll searches back from the newest message output
 	configPath   string
+	profile      string
 	timeRange    int
 	startDate    *time.Time
 	endDate      *time.Time
-	json         bool
+	output       string
+	columns      []string
+	table        *tableWriter
+	theme        *colorTheme
+	indexes      []string
+	grep         *grepFilter
+	queryTerms   []grepPattern // terms of the query highlighted in the output
+	groupBy      []string
+	facetLimit   int
 	serverConfig *config.IniFile
 	color        bool
+	site         string
+	apiUri       string
+	verbose      bool
+	client       *http.Client
+	stats        bool
+	formats      []*compiledFormat
+	listFormats  bool
 }
 
-// parseArgs parses the command-line arguments.
+// parseArgs parses the command-line arguments of a command, args[0] being the program name. The command is empty for
+// a search.
 // returns: *options which contains both the parsed command-line arguments.
-func parseArgs() *options {
+func parseArgs(command string, args []string) *options {
 	parser := argparse.NewParser("datadog", "Search and tail logs from Datadog.")
 
 	var defaultConfigPath = expandPath(DefaultConfigPath)
 
 	service := parser.String("s", "service", &argparse.Options{Required: false, Help: "Special case to search the 'service' message field, e.g., -s send-email is equivalent to -q 'service:send-email'. Merged with the -q query using 'AND' if the -q query is present."})
 	query := parser.String("q", "query", &argparse.Options{Required: false, Help: "Query terms to search on (Doglog search syntax). Defaults to '*'."})
-	limit := parser.Int("l", "limit", &argparse.Options{Required: false, Help: "The maximum number of messages to request from Datadog. Must be greater then 0", Default: DefaultLimit})
-	tail := parser.Flag("t", "tail", &argparse.Options{Required: false, Help: "Whether to tail the output. Requires a relative search."})
+	limit := parser.Int("l", "limit", &argparse.Options{Required: false, Help: "The maximum number of messages to request from Datadog in a single page. Must be greater then 0", Default: DefaultLimit})
+	maxResults := parser.Int("m", "max-results", &argparse.Options{Required: false, Help: "Same as --last."})
+	first := parser.Int("", "first", &argparse.Options{Required: false, Help: "Output only the first (oldest) N matching messages, e.g., the first error after a deploy. Ignored when tailing."})
+	last := parser.Int("", "last", &argparse.Options{Required: false, Help: "Output only the last (newest) N matching messages. Ignored when tailing."})
+	sortOrder := parser.Selector("", "sort", []string{sortAsc, sortDesc}, &argparse.Options{Required: false, Help: "Output order: asc for oldest first, desc for newest first. Tailing is always oldest first.", Default: sortAsc})
+	tail := parser.Flag("t", "tail", &argparse.Options{Required: false, Help: "Whether to tail the output. Requires a relative search. Starts with the newest page of messages in the --range."})
+	tailOverlap := parser.String("", "tail-overlap", &argparse.Options{Required: false, Help: "How far back each tail poll searches from the newest message already output, to pick up messages ingested late. Messages ingested later than this are never output. Examples: 30s, 5m", Default: DefaultTailOverlap})
 	configPath := parser.String("c", "config", &argparse.Options{Required: false, Help: "Path to the config file", Default: defaultConfigPath})
+	profile := parser.String("p", "profile", &argparse.Options{Required: false, Help: "Config profile to use, i.e., a [server.<profile>] or [profile <profile>] section. Defaults to $" + ProfileEnv + ", then the plain [server] section."})
 	timeRange := parser.String("r", "range", &argparse.Options{Required: false, Help: "Time range to search backwards from the current moment. Examples: 30m, 2h, 4d", Default: DefaultRange})
 	start := parser.String("", "start", &argparse.Options{Required: false, Help: "Starting time to search from. Allows variable formats, including '1:32pm' or '1/4/2019 12:30:00'."})
 	end := parser.String("", "end", &argparse.Options{Required: false, Help: "Ending time to search from. Allows variable formats, including '6:45am' or '2019-01-04 12:30:00'. Defaults to now if --start is provided but no --end."})
-	json := parser.Flag("j", "json", &argparse.Options{Required: false, Help: "Output messages in json format. Shows the modified log message, not the untouched message from Datadog. Useful in understanding the fields available when creating Format templates or for further processing."})
-	noColor := parser.Flag("", "no-colors", &argparse.Options{Required: false, Help: "Don't use colors in output."})
+	json := parser.Flag("j", "json", &argparse.Options{Required: false, Help: "Same as --output ndjson."})
+	output := parser.Selector("o", "output", outputModes, &argparse.Options{Required: false, Help: "Output mode. text: the format templates. ndjson (or json): one JSON object per message with all the fields, including the computed ones (_level, _message_text, ...), and tags. ndjson-raw: the attributes as received from Datadog, nested and with their types, the id and tags. csv, tsv: the --columns with a header row. logfmt: the --columns (default: all fields) as key=value pairs. raw: see --raw.", Default: outputText})
+	raw := parser.Flag("", "raw", &argparse.Options{Required: false, Help: "Same as --output raw: output every event exactly as returned by Datadog, one JSON object per line, with its id, tags and nested attributes. No field is computed and no format is applied."})
+	columns := parser.String("", "columns", &argparse.Options{Required: false, Help: "Comma separated fields output by csv, tsv and logfmt, 'id' and 'tags' are the message id and tags. Default for csv and tsv: " + strings.Join(defaultColumns, ",")})
+	color := parser.Selector("", "color", []string{colorAuto, colorAlways, colorNever}, &argparse.Options{Required: false, Help: "Whether to use colors in output. auto uses colors when the output is a terminal, unless $" + NoColorEnv + " is set or $" + CliColorEnv + " is 0. $" + ForceColorEnv + " turns them on.", Default: colorAuto})
+	noColor := parser.Flag("", "no-colors", &argparse.Options{Required: false, Help: "Same as --color never."})
+	format := parser.String("f", "format", &argparse.Options{Required: false, Help: "Output every message with the named format from the config file, instead of trying the formats in order."})
+	tmpl := parser.String("", "template", &argparse.Options{Required: false, Help: "Output every message with this Go template, e.g., '{{._long_time_timestamp}} {{.service}} {{._message_text}}'."})
+	index := parser.StringList("i", "index", &argparse.Options{Required: false, Help: "Log index to search, can be repeated or comma separated. Overrides the 'indexes' config key. Defaults to the default index. 'doglog indexes' lists the indexes."})
+	grep := parser.StringList("", "grep", &argparse.Options{Required: false, Help: "Only output the messages whose text matches this regular expression, highlighting the matches. '@<field>:<regex>' matches a field instead, e.g., '@http.url:^/api/'. Can be repeated, all patterns must match."})
+	grepAny := parser.Flag("", "grep-any", &argparse.Options{Required: false, Help: "Output the messages matching any of the --grep patterns, instead of all of them."})
+	grepV := parser.StringList("", "grep-v", &argparse.Options{Required: false, Help: "Don't output the messages matching this regular expression, same syntax as --grep. Can be repeated."})
+	groupBy := parser.String("", "group-by", &argparse.Options{Required: false, Help: "Comma separated facets to count the messages by, only with 'doglog count', e.g., service,@http.status_code."})
+	facetLimit := parser.Int("", "facet-limit", &argparse.Options{Required: false, Help: "The number of values kept per facet by 'doglog count', largest counts first.", Default: DefaultFacetLimit})
+	listFormats := parser.Flag("", "list-formats", &argparse.Options{Required: false, Help: "List the names, templates and match rules of the configured formats, then exit."})
+	stats := parser.Flag("", "stats", &argparse.Options{Required: false, Help: "Report how many messages were output with each format on stderr when done."})
+	verbose := parser.Flag("v", "verbose", &argparse.Options{Required: false, Help: "Report the Datadog rate limit budget and retries on stderr."})
+	site := parser.String("", "site", &argparse.Options{Required: false, Help: "Datadog site to query, e.g., us1, eu, us3, us5, ap1, gov or a site domain such as datadoghq.eu. Defaults to $" + SiteEnv + ", then the 'site' config key, then us1."})
+	timeout := parser.String("", "timeout", &argparse.Options{Required: false, Help: "Timeout for each call to Datadog, e.g., 30s or 2m. Overrides the [http] 'timeout' config key. Default: " + config.DefaultTimeout.String()})
+	proxy := parser.String("", "proxy", &argparse.Options{Required: false, Help: "Proxy URL for calls to Datadog. Overrides the [http] 'proxy' config key. Defaults to the HTTPS_PROXY environment variable."})
+	caFile := parser.String("", "ca-file", &argparse.Options{Required: false, Help: "PEM file with extra CA certificates to trust. Overrides the [http] 'ca-file' config key."})
+	insecure := parser.Flag("", "insecure", &argparse.Options{Required: false, Help: "Skip TLS certificate verification. Only meant for local stub servers."})
 
-	if err := parser.Parse(os.Args); err != nil {
+	if err := parser.Parse(args); err != nil {
 		invalidArgs(parser, err, "")
 	}
 
@@ -73,39 +150,187 @@ func parseArgs() *options {
 		tail = &newTail
 	}
 
-	var newQuery string
-	if len(*service) > 0 {
-		newQuery = "service:" + *service
-		if len(*query) > 0 {
-			newQuery += " AND " + *query
-		}
-		query = &newQuery
+	fromStart := false
+	if *first > 0 && (*last > 0 || *maxResults > 0) {
+		invalidArgs(parser, nil, "Use either --first or --last")
+	}
+	if *first > 0 {
+		maxResults = first
+		fromStart = true
+	} else if *last > 0 {
+		maxResults = last
+	}
+
+	if *maxResults < 0 || *tail {
+		var newMaxResults = 0
+		maxResults = &newMaxResults
 	}
 
 	opts := options{
-		service:    *service,
-		query:      *query,
-		limit:      *limit,
-		tail:       *tail,
-		configPath: *configPath,
-		timeRange:  timeRangeToSeconds(parser, *timeRange),
-		startDate:  startDate,
-		endDate:    endDate,
-		json:       *json,
-		color:      !*noColor && isTty(),
+		service:     *service,
+		query:       *query,
+		limit:       *limit,
+		maxResults:  *maxResults,
+		fromStart:   fromStart,
+		sort:        *sortOrder,
+		tail:        *tail,
+		tailOverlap: timeRangeToSeconds(parser, *tailOverlap),
+		configPath:  *configPath,
+		profile:     *profile,
+		timeRange:   timeRangeToSeconds(parser, *timeRange),
+		startDate:   startDate,
+		endDate:     endDate,
+		output:      *output,
+		color:       !*noColor && useColors(*color, os.Getenv, isTty(os.Stdout)),
+		site:        *site,
+		verbose:     *verbose,
+		stats:       *stats,
+		listFormats: *listFormats,
+	}
+
+	if *json || opts.output == outputNdjsonAlias {
+		opts.output = outputNdjson
+	}
+	if *raw {
+		opts.output = outputRaw
+	}
+	if len(opts.output) == 0 {
+		opts.output = outputText
+	}
+	opts.columns = splitList(*columns)
+	opts.groupBy = splitList(*groupBy)
+	if len(opts.groupBy) > 0 && command != countCommand {
+		invalidArgs(parser, nil, "--group-by only works with 'doglog "+countCommand+"'")
+	}
+	opts.facetLimit = *facetLimit
+	if opts.facetLimit <= 0 {
+		opts.facetLimit = DefaultFacetLimit
+	}
+	// Escape sequences would corrupt the structured outputs
+	if opts.output != outputText {
+		opts.color = false
+	}
+
+	grepFilter, err := newGrepFilter(*grep, *grepV, *grepAny)
+	if err != nil {
+		invalidArgs(parser, err, "The --grep pattern can't be parsed")
+	}
+	opts.grep = grepFilter
+
+	if len(opts.profile) == 0 {
+		opts.profile = os.Getenv(ProfileEnv)
 	}
 
 	// Read the configuration file
-	cfg, err := config.New(opts.configPath)
+	cfg, err := config.New(opts.configPath, opts.profile)
 	if err != nil {
 		invalidArgs(parser, err, "")
 	}
 
 	opts.serverConfig = cfg
+	if len(*tmpl) > 0 {
+		opts.formats, err = adHocFormat(*tmpl)
+		if err != nil {
+			invalidArgs(parser, err, "The --template can't be parsed")
+		}
+	} else if len(*format) > 0 {
+		opts.formats, err = namedFormat(cfg.Formats(), *format)
+		if err != nil {
+			invalidArgs(parser, err, "")
+		}
+	} else if !opts.listFormats {
+		opts.formats = compileFormats(cfg.Formats())
+	}
+
+	// The profile's indexes are used when no --index is given
+	for _, value := range *index {
+		opts.indexes = append(opts.indexes, splitList(value)...)
+	}
+	if len(opts.indexes) == 0 {
+		opts.indexes = cfg.Indexes()
+	}
+	if len(opts.indexes) > 1 && cfg.ApiVersion() == config.ApiVersion1 {
+		invalidArgs(parser, nil, "The v1 API searches a single index, use api-version v2 to search several indexes")
+	}
+
+	// The profile's default query is used when no query is given
+	if len(opts.query) == 0 {
+		opts.query = cfg.Query()
+	}
+	if len(opts.service) > 0 {
+		newQuery := "service:" + opts.service
+		if len(opts.query) > 0 {
+			newQuery += " AND " + opts.query
+		}
+		opts.query = newQuery
+	}
+	opts.queryTerms = parseQueryTerms(opts.query)
+
+	if len(opts.site) == 0 {
+		opts.site = os.Getenv(SiteEnv)
+	}
+	if len(opts.site) == 0 {
+		opts.site = cfg.Site()
+	}
+	opts.apiUri, err = datadogBaseUri(opts.site, cfg.ApiUrl())
+	if err != nil {
+		invalidArgs(parser, err, "")
+	}
+
+	settings := clientSettings{
+		timeout:            cfg.Timeout(),
+		proxy:              cfg.Proxy(),
+		caFile:             expandPath(cfg.CaFile()),
+		insecureSkipVerify: *insecure || cfg.InsecureSkipVerify(),
+	}
+	if len(*timeout) > 0 {
+		settings.timeout, err = time.ParseDuration(*timeout)
+		if err != nil {
+			invalidArgs(parser, err, "The --timeout can't be parsed")
+		}
+	}
+	if len(*proxy) > 0 {
+		settings.proxy = *proxy
+	}
+	if len(*caFile) > 0 {
+		settings.caFile = expandPath(*caFile)
+	}
+	opts.client, err = newHttpClient(settings)
+	if err != nil {
+		invalidArgs(parser, err, "")
+	}
 
 	return &opts
 }
 
+// parseConfigCheckArgs parses the command-line arguments of 'doglog config check'.
+// returns: *options with only the config path set.
+func parseConfigCheckArgs() *options {
+	parser := argparse.NewParser("doglog config check", "Validate the configuration file: format templates, sections, keys and credentials of every profile.")
+
+	configPath := parser.String("c", "config", &argparse.Options{Required: false, Help: "Path to the config file", Default: expandPath(DefaultConfigPath)})
+
+	if len(os.Args) < 3 || os.Args[2] != checkSubcommand {
+		invalidArgs(parser, nil, "Unknown config command, expected: doglog config check")
+	}
+	if err := parser.Parse(append([]string{os.Args[0]}, os.Args[3:]...)); err != nil {
+		invalidArgs(parser, err, "")
+	}
+
+	return &options{configPath: *configPath}
+}
+
+// Split a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
 // Convert a variable human-friendly date into a time.Time.
 func strToDate(parser *argparse.Parser, dateStr string, errorStr string, defaultToNow bool) *time.Time {
 	var dateTime time.Time
@@ -179,7 +404,7 @@ func invalidArgs(parser *argparse.Parser, err error, msg string) {
 	} else if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "%s\n\n", err.Error())
 	}
-	_, _ = fmt.Fprintf(os.Stderr, parser.Usage(nil))
+	_, _ = fmt.Fprint(os.Stderr, parser.Usage(nil))
 	os.Exit(1)
 }
 
@@ -198,8 +423,25 @@ func expandPath(configPath string) string {
 }
 
 // Check to see whether we're outputting to a terminal or if we've been redirected to a file
-func isTty() bool {
-	//_, err := unix.IoctlGetTermios(int(os.Stdout.Fd()), unix.TIOCGETA)
-	//return err == nil
-	return true
+func isTty(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// Decide whether to output colors. An explicit --color always or never wins. With auto, FORCE_COLOR turns colors on,
+// then NO_COLOR (https://no-color.org) or CLICOLOR=0 turn them off, otherwise colors are used when stdout is a
+// terminal.
+func useColors(mode string, getenv func(string) string, terminal bool) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if force := getenv(ForceColorEnv); len(force) > 0 && force != "0" && force != "false" {
+		return true
+	}
+	if len(getenv(NoColorEnv)) > 0 || getenv(CliColorEnv) == "0" {
+		return false
+	}
+	return terminal
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Settings of the HTTP client used for every call to Datadog.
+type clientSettings struct {
+	timeout            time.Duration // whole request timeout, 0 for none
+	proxy              string        // proxy URL, empty to use the environment (HTTPS_PROXY, NO_PROXY)
+	caFile             string        // PEM bundle of extra trusted certificates
+	insecureSkipVerify bool          // skip TLS verification, only meant for local stubs
+}
+
+// Create the HTTP client shared by all calls to Datadog. Connections are kept alive between calls, so paging through
+// results and tailing reuse the same connection.
+func newHttpClient(settings clientSettings) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(settings.proxy) > 0 {
+		proxyUrl, err := url.Parse(settings.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %s: %s", settings.proxy, err.Error())
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: settings.insecureSkipVerify}
+	if len(settings.caFile) > 0 {
+		pem, err := ioutil.ReadFile(settings.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA file not readable at %s", settings.caFile)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", settings.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: settings.timeout}, nil
+}
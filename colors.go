@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Escape sequences of the named colors. The same bright colors as the template fields (_red, _blue, ...).
+var namedColors = map[string]int{
+	"black": 30, "red": 91, "green": 92, "yellow": 93, "blue": 94, "magenta": 95, "cyan": 96, "white": 97,
+	"grey": 37, "gray": 37, "default": 39,
+}
+
+// SGR codes of the text styles.
+var colorStyles = map[string]int{
+	"bold": 1, "dim": 2, "italic": 3, "underline": 4, "blink": 5, "reverse": 7,
+}
+
+// Keyword that turns the next color into the background color, e.g., 'white on red'.
+const backgroundKeyword = "on"
+
+// Alternative prefix of the truecolor values. In the configuration file, '#' starts a comment.
+const truecolorPrefix = "rgb:"
+
+// Offset between the foreground and background codes of the named colors.
+const backgroundOffset = 10
+
+// Levels that can be given a color in the [colors] section, by their lower-case name.
+var colorLevels = []string{debugLevel, traceLevel, infoLevel, warnLevel, errorLevel, fatalLevel}
+
+// colorTheme holds the escape sequences output in color mode: the template fields (_red, _blue... and the colors
+// added in the [colors] section) and the color of each level.
+type colorTheme struct {
+	fields map[string]string
+	levels map[string]string
+}
+
+// Parse a color specification: any number of styles (bold, dim, italic, underline, blink, reverse), a foreground
+// color and, after 'on', a background color. Colors are names (red, grey...), 256-color numbers (0-255) or truecolor
+// hex values (#ff8800 or rgb:ff8800). E.g., 'bold white on red', 'underline 208', 'rgb:ff8800 on rgb:202020'.
+// returns: the escape sequence, empty for an empty specification.
+func parseColorSpec(spec string) (string, error) {
+	var codes []string
+	background := false
+	for _, token := range strings.Fields(strings.ToLower(spec)) {
+		if token == backgroundKeyword {
+			background = true
+			continue
+		}
+		if code, ok := colorStyles[token]; ok && !background {
+			codes = append(codes, strconv.Itoa(code))
+			continue
+		}
+		code, err := colorCode(token, background)
+		if err != nil {
+			return "", err
+		}
+		codes = append(codes, code)
+		background = false
+	}
+	if background {
+		return "", fmt.Errorf("missing background color after '%s' in '%s'", backgroundKeyword, spec)
+	}
+	if len(codes) == 0 {
+		return "", nil
+	}
+	return "\033[" + strings.Join(codes, ";") + "m", nil
+}
+
+// Get the SGR code of a single color, as a foreground or background color.
+func colorCode(color string, background bool) (string, error) {
+	if code, ok := namedColors[color]; ok {
+		if background {
+			code += backgroundOffset
+		}
+		return strconv.Itoa(code), nil
+	}
+	prefix := "38;"
+	if background {
+		prefix = "48;"
+	}
+	if n, err := strconv.Atoi(color); err == nil && n >= 0 && n <= 255 {
+		return prefix + "5;" + color, nil
+	}
+	hex := strings.TrimPrefix(strings.TrimPrefix(color, "#"), truecolorPrefix)
+	if len(hex) == 6 && hex != color {
+		if rgb, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return fmt.Sprintf("%s2;%d;%d;%d", prefix, rgb>>16, (rgb>>8)&0xff, rgb&0xff), nil
+		}
+	}
+	return "", fmt.Errorf("unknown color or style '%s', expected a color name, 0-255, #rrggbb, rgb:rrggbb or one of bold, "+
+		"dim, italic, underline, blink, reverse", color)
+}
+
+// Build the color theme: the built-in colors overridden by the [colors] section. Level keys (error, warn...) set
+// the color of the level, every key is also available in templates as '_<key>'. Colors that can't be parsed are
+// skipped.
+func newColorTheme(specs map[string]string) *colorTheme {
+	theme := &colorTheme{
+		fields: map[string]string{
+			blueField: blueEsc, redField: redEsc, greenField: greenEsc, yellowField: yellowEsc, greyField: greyEsc,
+			whiteField: whiteEsc, cyanField: cyanEsc, magentaField: magentaEsc, resetField: resetEsc,
+			highlightField: highlightEsc, termField: termEsc,
+		},
+		levels: map[string]string{
+			debugLevel: debugEsc, traceLevel: debugEsc, infoLevel: infoEsc, warnLevel: warnEsc, errorLevel: errorEsc,
+			fatalLevel: errorEsc,
+		},
+	}
+	for name, spec := range specs {
+		esc, err := parseColorSpec(spec)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping color %s: %s\n", name, err.Error())
+			continue
+		}
+		for _, level := range colorLevels {
+			if strings.EqualFold(name, level) {
+				theme.levels[level] = esc
+			}
+		}
+		theme.fields["_"+name] = esc
+	}
+	return theme
+}
+
+// Get the color theme, building it on first use.
+func messageTheme(opts *options) *colorTheme {
+	if opts.theme == nil {
+		opts.theme = newColorTheme(opts.serverConfig.Colors())
+	}
+	return opts.theme
+}
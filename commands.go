@@ -1,30 +1,216 @@
 package main
 
-import "github.com/briandowns/spinner"
+import (
+	"./config"
+	"encoding/csv"
+	"fmt"
+	"github.com/Masterminds/sprig"
+	"github.com/briandowns/spinner"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
 
-// Print out the log messages that match the search criteria.
-func commandListMessages(opts *options, s *spinner.Spinner) bool {
+// Print out the log messages that match the search criteria. Pages through the results, passing the cursor returned
+// with each page into the next request, until Datadog runs out of messages or --max-results messages were printed.
+// The tracker is only present when tailing, it limits the search to new messages.
+// returns: whether any messages were output, and the error that stopped the search, if any.
+func commandListMessages(opts *options, s *spinner.Spinner, tracker *tailTracker) (bool, error) {
 	found := false
-	for {
+	count := 0
+	singlePage := false
+	query := newSearchRequest(opts, "")
+	if tracker != nil {
+		singlePage = tracker.narrow(&query)
+	}
+	// Messages fetched in the opposite order of the output (e.g., --last with the default order, or the first tail
+	// poll) are collected and output in reverse once the search is done
+	var collected []logMessage
+	reverse := query.sort != outputOrder(opts)
+	for page := 1; ; page++ {
+		search := query
+		if opts.maxResults > 0 && opts.maxResults-count < search.limit {
+			search.limit = opts.maxResults - count
+		}
+		if s != nil {
+			s.Suffix = fmt.Sprintf(" page %d (%d messages)", page, count)
+		}
+		messages, nextCursor, err := fetchMessages(opts, search)
+		if err != nil {
+			return found, err
+		}
+		if tracker != nil {
+			messages = tracker.filter(messages)
+		}
 		if s != nil {
 			s.Stop()
 		}
-		messages, nextId := fetchMessages(opts, "")
-		if len(messages) > 0 {
+		for _, msg := range messages {
+			if !keepMessage(opts, msg) {
+				continue
+			}
 			found = true
-			for _, msg := range messages {
+			if reverse {
+				collected = append(collected, msg)
+			} else {
 				printMessage(opts, msg)
 			}
+			count++
+			if opts.maxResults > 0 && count >= opts.maxResults {
+				break
+			}
 		}
 		if s != nil {
 			s.Start()
 		}
-		if len(nextId) == 0 {
+		if len(nextCursor) == 0 || singlePage || (opts.maxResults > 0 && count >= opts.maxResults) {
 			break
 		} else {
+			query.cursor = nextCursor
 			delayForSeconds(0.2)
 		}
 	}
+	if s != nil && len(collected) > 0 {
+		s.Stop()
+	}
+	for i := len(collected) - 1; i >= 0; i-- {
+		printMessage(opts, collected[i])
+	}
+	if tracker != nil {
+		tracker.done()
+	}
+
+	return found, nil
+}
 
-	return found
+// Print the name, template and match rule of every configured format, in the order they are tried.
+func commandListFormats(opts *options) {
+	for _, f := range opts.serverConfig.Formats() {
+		fmt.Printf("%s: %s\n", f.Name, f.Format)
+		if len(f.Match) > 0 {
+			fmt.Printf("%s%s: %s\n", f.Name, config.MatchSuffix, f.Match)
+		}
+	}
+}
+
+// List the log indexes that can be searched with --index: name, retention, daily limit and filter.
+// returns: the process exit code, 1 when the indexes can't be fetched.
+func commandListIndexes(opts *options) int {
+	indexes, err := fetchIndexes(opts)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tRETENTION\tDAILY LIMIT\tFILTER")
+	for _, index := range indexes {
+		limit := "none"
+		if index.DailyLimit != nil {
+			limit = strconv.FormatInt(*index.DailyLimit, 10)
+		}
+		if index.IsRateLimited {
+			limit += " (reached)"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%dd\t%s\t%s\n", index.Name, index.NumRetentionDays, limit, index.Filter.Query)
+	}
+	_ = w.Flush()
+	return 0
+}
+
+// Count the messages matching the search per combination of the --group-by facet values and print the counts,
+// largest first: a table by default, one JSON object per group with --output ndjson, csv or tsv for scripts.
+// returns: the process exit code, 1 on errors.
+func commandCount(opts *options, s *spinner.Spinner) int {
+	if len(opts.groupBy) == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "doglog count needs the facets to count by, e.g., --group-by service,@http.status_code")
+		return 1
+	}
+	if opts.output == outputLogfmt || opts.output == outputRaw {
+		_, _ = fmt.Fprintf(os.Stderr, "doglog count doesn't support --output %s\n", opts.output)
+		return 1
+	}
+
+	if s != nil {
+		s.Start()
+	}
+	groups, err := fetchCounts(opts, newSearchRequest(opts, ""), opts.groupBy)
+	if s != nil {
+		s.Stop()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	switch opts.output {
+	case outputNdjson, outputNdjsonAlias, outputNdjsonRaw:
+		for _, group := range groups {
+			object := make(map[string]interface{}, len(group.values)+1)
+			for facet, value := range group.values {
+				object[facet] = value
+			}
+			object[countColumn] = group.count
+			fmt.Println(encodeJson(object))
+		}
+	case outputCsv, outputTsv:
+		writer := csv.NewWriter(os.Stdout)
+		if opts.output == outputTsv {
+			writer.Comma = '\t'
+		}
+		_ = writer.Write(append(append([]string{}, opts.groupBy...), countColumn))
+		for _, group := range groups {
+			row := make([]string, 0, len(opts.groupBy)+1)
+			for _, facet := range opts.groupBy {
+				row = append(row, facetValue(group.values[facet]))
+			}
+			_ = writer.Write(append(row, strconv.FormatInt(group.count, 10)))
+		}
+		writer.Flush()
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, strings.ToUpper(strings.Join(append(append([]string{}, opts.groupBy...), countColumn), "\t")))
+		for _, group := range groups {
+			for _, facet := range opts.groupBy {
+				_, _ = fmt.Fprintf(w, "%s\t", facetValue(group.values[facet]))
+			}
+			_, _ = fmt.Fprintf(w, "%d\n", group.count)
+		}
+		_ = w.Flush()
+	}
+	return 0
+}
+
+// Validate the configuration file and print the problems found, prefixed with the file path and line number.
+// returns: the process exit code, 1 when there are errors.
+func commandConfigCheck(opts *options) int {
+	validateMatch := func(expr string) error {
+		_, err := parseMatchRule(expr)
+		return err
+	}
+	validateColor := func(spec string) error {
+		_, err := parseColorSpec(spec)
+		return err
+	}
+	diagnostics, err := config.Check(opts.configPath, sprig.TxtFuncMap(), validateMatch, validateColor)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	errorCount := 0
+	for _, d := range diagnostics {
+		fmt.Printf("%s:%s\n", opts.configPath, d.String())
+		if d.Severity == config.SeverityError {
+			errorCount++
+		}
+	}
+	if len(diagnostics) == 0 {
+		fmt.Printf("%s: ok\n", opts.configPath)
+	}
+	if errorCount > 0 {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"gopkg.in/ini.v1"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Severities of a configuration problem.
+const SeverityError = "error"
+const SeverityWarning = "warning"
+
+// Diagnostic describes a single problem found in the configuration file.
+type Diagnostic struct {
+	Line     int // 1-based line number, 0 when the problem isn't tied to a line
+	Severity string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line > 0 {
+		return fmt.Sprintf("%d: %s: %s", d.Line, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+}
+
+// Keys allowed in each kind of section. Formats and fields accept any key.
+var serverKeys = []string{"api-key", "api-key-command", "api-key-file", "application-key", "application-key-command",
+	"application-key-file", "site", "api-url", "api-version", "query", "indexes"}
+var httpKeys = []string{"timeout", "proxy", "ca-file", "insecure-skip-verify"}
+
+// A '{' followed by a field reference that isn't the start of an action, e.g., '{._magenta}}'. Go templates output
+// it as plain text, which is almost never what was meant.
+var singleBraceRegex = regexp.MustCompile(`(^|[^{]){\.[A-Za-z_][A-Za-z0-9_]*`)
+
+// Color names become template fields ('_<name>'), so they must be usable in '{{._<name>}}'.
+var colorNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Line numbers of the sections and keys in the configuration file. ini.File doesn't keep them.
+type lineIndex struct {
+	sections map[string]int
+	keys     map[string]int // "<section>\x00<key>"
+}
+
+// Check validates the configuration file: every format template must parse with the given template functions, every
+// format match rule must be accepted by validateMatch, every color must be accepted by validateColor, all sections and
+// keys must be known, values must be valid and the keys of every profile must resolve.
+// returns: the problems found sorted by line, or an error when the file can't be read at all.
+func Check(configPath string, funcs template.FuncMap, validateMatch func(string) error,
+	validateColor func(string) error) ([]Diagnostic, error) {
+	f, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := indexLines(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics []Diagnostic
+	report := func(line int, severity string, format string, args ...interface{}) {
+		diagnostics = append(diagnostics, Diagnostic{Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	c := &IniFile{ini: f}
+	profiles := make(map[string]bool)
+	for _, profile := range c.Profiles() {
+		profiles[profile] = true
+	}
+
+	for _, section := range f.Sections() {
+		name := section.Name()
+		line := lines.sections[name]
+		base, profile := splitSectionName(name)
+		if len(profile) > 0 && base != serverSection && base != profilePrefix && !profiles[profile] {
+			report(line, SeverityWarning, "section [%s] belongs to profile %s, which isn't defined", name, profile)
+		}
+		switch base {
+		case ini.DefaultSection:
+			for _, key := range section.Keys() {
+				report(lines.key(name, key.Name()), SeverityWarning, "key %s is outside of any section", key.Name())
+			}
+		case serverSection, profilePrefix:
+			checkKeys(section, serverKeys, lines, report)
+			if key, err := ownKey(section, "api-version"); err == nil && key.In("", []string{ApiVersion1, ApiVersion2}) == "" {
+				report(lines.key(name, key.Name()), SeverityError, "api-version must be %s or %s, not %s", ApiVersion1, ApiVersion2, key.Value())
+			}
+		case httpSection:
+			if len(profile) > 0 {
+				report(line, SeverityWarning, "unknown section [%s], the [%s] settings apply to every profile", name, httpSection)
+				break
+			}
+			checkKeys(section, httpKeys, lines, report)
+			if key, err := ownKey(section, "timeout"); err == nil {
+				if _, err := time.ParseDuration(key.Value()); err != nil {
+					report(lines.key(name, key.Name()), SeverityError, "timeout can't be parsed: %s", err.Error())
+				}
+			}
+			if key, err := ownKey(section, "insecure-skip-verify"); err == nil {
+				if _, err := key.Bool(); err != nil {
+					report(lines.key(name, key.Name()), SeverityError, "insecure-skip-verify must be true or false")
+				}
+			}
+		case formatsSection:
+			for _, key := range section.Keys() {
+				line := lines.key(name, key.Name())
+				if !strings.HasSuffix(key.Name(), MatchSuffix) {
+					checkFormat(key, funcs, line, report)
+					continue
+				}
+				format := strings.TrimSuffix(key.Name(), MatchSuffix)
+				if _, err := ownKey(section, format); err != nil {
+					report(line, SeverityWarning, "match rule %s has no format %s", key.Name(), format)
+				}
+				if err := validateMatch(key.Value()); err != nil {
+					report(line, SeverityError, "match rule %s: %s", key.Name(), err.Error())
+				}
+			}
+		case colorsSection:
+			for _, key := range section.Keys() {
+				line := lines.key(name, key.Name())
+				if !colorNameRegex.MatchString(key.Name()) {
+					report(line, SeverityWarning, "color %s can't be used in templates, names may only contain letters, digits and '_'", key.Name())
+				}
+				if err := validateColor(key.Value()); err != nil {
+					report(line, SeverityError, "color %s: %s", key.Name(), err.Error())
+				}
+			}
+		case fieldSection:
+		default:
+			report(line, SeverityWarning, "unknown section [%s]", name)
+		}
+	}
+
+	// Every profile needs both keys, and so does the plain [server] section when it's there or there are no profiles
+	checked := c.Profiles()
+	if _, err := f.GetSection(serverSection); err == nil || len(checked) == 0 {
+		checked = append([]string{""}, checked...)
+	}
+	for _, profile := range checked {
+		p := &IniFile{ini: f, profile: profile}
+		line := lines.sections[serverSection]
+		if len(profile) > 0 {
+			line = lines.sections[p.profileSection().Name()]
+		}
+		if _, err := p.ApiKey(); err != nil {
+			report(line, SeverityError, "%s", err.Error())
+		}
+		if _, err := p.ApplicationKey(); err != nil {
+			report(line, SeverityError, "%s", err.Error())
+		}
+	}
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+	return diagnostics, nil
+}
+
+// Split a section name into its kind and profile, e.g., 'formats.prod' into 'formats' and 'prod', 'profile eu' into
+// 'profile ' and 'eu'.
+func splitSectionName(name string) (base string, profile string) {
+	if strings.HasPrefix(name, profilePrefix) {
+		return profilePrefix, strings.TrimSpace(strings.TrimPrefix(name, profilePrefix))
+	}
+	if i := strings.Index(name, profileSeparator); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// Get a key of the section itself. Unlike GetKey, keys inherited from a parent section (e.g., [server] for
+// [server.prod]) aren't returned.
+func ownKey(section *ini.Section, name string) (*ini.Key, error) {
+	for _, key := range section.Keys() {
+		if key.Name() == name {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key %s not found in section [%s]", name, section.Name())
+}
+
+// Report the keys of a section that aren't in the allowed list.
+func checkKeys(section *ini.Section, allowed []string, lines lineIndex, report func(int, string, string, ...interface{})) {
+	for _, key := range section.Keys() {
+		known := false
+		for _, name := range allowed {
+			if key.Name() == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			report(lines.key(section.Name(), key.Name()), SeverityWarning, "unknown key %s in section [%s]", key.Name(), section.Name())
+		}
+	}
+}
+
+// Report a format template that doesn't parse or that looks broken.
+func checkFormat(key *ini.Key, funcs template.FuncMap, line int, report func(int, string, string, ...interface{})) {
+	if _, err := template.New(key.Name()).Funcs(funcs).Parse(key.Value()); err != nil {
+		report(line, SeverityError, "format %s doesn't parse: %s", key.Name(), err.Error())
+	}
+	if match := singleBraceRegex.FindString(key.Value()); len(match) > 0 {
+		report(line, SeverityWarning, "format %s has a single '{' before a field (%s), it will be output as text",
+			key.Name(), strings.TrimSpace(match))
+	}
+}
+
+// Find the line numbers of the sections and keys in the configuration file.
+func indexLines(configPath string) (lineIndex, error) {
+	index := lineIndex{sections: make(map[string]int), keys: make(map[string]int)}
+
+	configPath, _ = filepath.Abs(configPath)
+	file, err := os.Open(configPath)
+	if err != nil {
+		return index, fmt.Errorf("configuration file not found or not readable at %s", configPath)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	section := ini.DefaultSection
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := index.sections[section]; !ok {
+				index.sections[section] = number
+			}
+			continue
+		}
+		if i := strings.IndexAny(line, "=:"); i > 0 {
+			key := section + "\x00" + strings.TrimSpace(line[:i])
+			if _, ok := index.keys[key]; !ok {
+				index.keys[key] = number
+			}
+		}
+	}
+	return index, scanner.Err()
+}
+
+// Line number of a key, falling back to the line of its section.
+func (l lineIndex) key(section string, key string) int {
+	if line, ok := l.keys[section+"\x00"+key]; ok {
+		return line
+	}
+	return l.sections[section]
+}
@@ -3,11 +3,15 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"gopkg.in/ini.v1"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const NoFormatDefined = "No Formats Defined>>"
@@ -17,80 +21,346 @@ const LevelField = "level"
 const MessageField = "message"
 const ClassnameField = "classname"
 
-const formatsSection string = "formats" // [formats]
-const serverSection string = "server"   // [server]
-const fieldSection string = "fields"    // [fields]
+// Supported Datadog log API versions.
+const ApiVersion1 = "v1"
+const ApiVersion2 = "v2"
 
-var storedFormats []FormatDefinition = nil // Stores formats so we don't keep re-reading them
-var storedFields map[string][]string = nil // Stores field mappings so we don't keep re-reading them
+const formatsSection string = "formats" // [formats], [formats.<profile>]
+const serverSection string = "server"   // [server], [server.<profile>]
+const fieldSection string = "fields"    // [fields], [fields.<profile>]
+const httpSection string = "http"       // [http]
+const colorsSection string = "colors"   // [colors], [colors.<profile>]
+const profilePrefix string = "profile " // [profile <profile>], same as [server.<profile>]
+const profileSeparator string = "."
+
+// MatchSuffix is the suffix of a [formats] key that holds the match rule of a format, e.g., 'java_1.match'.
+const MatchSuffix = ".match"
+
+// Environment variables that hold the keys. They win over the config file.
+const ApiKeyEnv = "DD_API_KEY"
+const ApplicationKeyEnv = "DD_APP_KEY"
+const ApplicationKeyAltEnv = "DD_APPLICATION_KEY"
+
+// Suffixes of the config keys that read a key from the output of a command or from a file, e.g., api-key-command.
+const commandSuffix = "-command"
+const fileSuffix = "-file"
+
+// DefaultTimeout is the timeout of a single call to Datadog when none is configured.
+const DefaultTimeout = 30 * time.Second
 
 // IniFile is a wrapper around the INI file reader
 type IniFile struct {
-	ini *ini.File
+	ini           *ini.File
+	profile       string              // Selected profile, empty when only the [server] section is used
+	storedFormats []FormatDefinition  // Stores formats so we don't keep re-reading them
+	storedFields  map[string][]string // Stores field mappings so we don't keep re-reading them
+	storedKeys    map[string]string   // Stores resolved keys so commands aren't run for every call
 }
 
 // FormatDefinition stores a single format line.
 type FormatDefinition struct {
 	Name   string
 	Format string
+	Match  string // Optional match rule from the '<name>.match' key, empty when the format has none
 }
 
-// New creates a new INI file reader and wraps it.
-func New(configPath string) (*IniFile, error) {
+// New creates a new INI file reader and wraps it. The profile selects a [server.<profile>] or [profile <profile>]
+// section, an empty profile only uses the [server] section.
+func New(configPath string, profile string) (*IniFile, error) {
 	f, err := readConfig(configPath)
-	if err == nil {
-		return &IniFile{ini: f}, nil
-	} else {
+	if err != nil {
 		return nil, err
 	}
+	c := &IniFile{ini: f, profile: profile}
+	if len(profile) > 0 && c.profileSection() == nil {
+		return nil, fmt.Errorf("profile %s not found in the configuration file (expected [%s%s%s] or [%s%s])",
+			profile, serverSection, profileSeparator, profile, profilePrefix, profile)
+	}
+	return c, nil
+}
+
+// Profile gets the name of the selected profile. Empty when no profile was selected.
+func (c *IniFile) Profile() string {
+	return c.profile
+}
+
+// Profiles gets the names of all profiles defined in the config file.
+func (c *IniFile) Profiles() (profiles []string) {
+	for _, name := range c.ini.SectionStrings() {
+		if strings.HasPrefix(name, serverSection+profileSeparator) {
+			profiles = append(profiles, strings.TrimPrefix(name, serverSection+profileSeparator))
+		} else if strings.HasPrefix(name, profilePrefix) {
+			profiles = append(profiles, strings.TrimSpace(strings.TrimPrefix(name, profilePrefix)))
+		}
+	}
+	return profiles
+}
+
+// Find the section of the selected profile.
+func (c *IniFile) profileSection() *ini.Section {
+	for _, name := range []string{serverSection + profileSeparator + c.profile, profilePrefix + c.profile} {
+		if section, err := c.ini.GetSection(name); err == nil {
+			return section
+		}
+	}
+	return nil
+}
+
+// Find the profile specific version of a section, e.g., [formats.<profile>]. Nil when there isn't one.
+func (c *IniFile) profileOverride(sectionName string) *ini.Section {
+	if len(c.profile) == 0 {
+		return nil
+	}
+	section, err := c.ini.GetSection(sectionName + profileSeparator + c.profile)
+	if err != nil {
+		return nil
+	}
+	return section
+}
+
+// Get a server key from the selected profile, falling back to the [server] section.
+func (c *IniFile) serverKey(name string) *ini.Key {
+	if len(c.profile) > 0 {
+		if section := c.profileSection(); section != nil && section.HasKey(name) {
+			return section.Key(name)
+		}
+	}
+	return c.ini.Section(serverSection).Key(name)
 }
 
-// ApiKey gets the API key from the config file. Defaults to an empty string.
-func (c *IniFile) ApiKey() string {
-	server := c.ini.Section(serverSection)
-	return server.Key("api-key").MustString("")
+// ApiKey gets the API key. See resolveKey for where the key can come from.
+func (c *IniFile) ApiKey() (string, error) {
+	return c.resolveKey("api-key", ApiKeyEnv)
 }
 
-// ApplicationKey gets the application key from the config file. Defaults to an empty string.
-func (c *IniFile) ApplicationKey() string {
-	server := c.ini.Section(serverSection)
-	return server.Key("application-key").MustString("")
+// ApplicationKey gets the application key. See resolveKey for where the key can come from.
+func (c *IniFile) ApplicationKey() (string, error) {
+	return c.resolveKey("application-key", ApplicationKeyEnv, ApplicationKeyAltEnv)
+}
+
+// Resolve a key. The first of these that is set wins:
+//  1. the environment variables
+//  2. <name>-command: a shell command whose output is the key, e.g., 'pass show dd/app-key'
+//  3. <name>-file: a file that holds the key
+//  4. <name>: the key itself
+//
+// The config keys are read from the selected profile, and only when the profile sets none of them, from the [server]
+// section.
+// returns: an error when the key can't be found or the command or file fails.
+func (c *IniFile) resolveKey(name string, envs ...string) (string, error) {
+	if key, ok := c.storedKeys[name]; ok {
+		return key, nil
+	}
+
+	key, err := c.lookupKey(name, envs)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		var sections []string
+		for _, section := range c.keySections() {
+			sections = append(sections, "["+section.Name()+"]")
+		}
+		return "", fmt.Errorf("no %s found: set %s, or %s%s, %s%s or %s in the %s section",
+			name, strings.Join(envs, " or "), name, commandSuffix, name, fileSuffix, name, strings.Join(sections, " or "))
+	}
+	if c.storedKeys == nil {
+		c.storedKeys = make(map[string]string)
+	}
+	c.storedKeys[name] = key
+	return key, nil
 }
 
-// Formats gets the log messages formats from the config file. Adds a final default format case so the user knows that
-// no formats were applied successfully.
+// Get the sections the keys are read from: the selected profile, then the [server] section.
+func (c *IniFile) keySections() (sections []*ini.Section) {
+	if len(c.profile) > 0 {
+		if section := c.profileSection(); section != nil {
+			sections = append(sections, section)
+		}
+	}
+	return append(sections, c.ini.Section(serverSection))
+}
+
+// Look up a key in the sources listed by resolveKey. Returns an empty key when none of them are set.
+func (c *IniFile) lookupKey(name string, envs []string) (string, error) {
+	for _, env := range envs {
+		if key := strings.TrimSpace(os.Getenv(env)); len(key) > 0 {
+			return key, nil
+		}
+	}
+	for _, section := range c.keySections() {
+		if key, err := sectionKey(section, name); err != nil || len(key) > 0 {
+			return key, err
+		}
+	}
+	return "", nil
+}
+
+// Look up a key in the config keys of a single section. Returns an empty key when none of them are set. Keys are
+// only read from the section itself, not from the parent section that ini falls back to for [server.<profile>].
+func sectionKey(section *ini.Section, name string) (string, error) {
+	keys := section.KeysHash()
+	if command := keys[name+commandSuffix]; len(command) > 0 {
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s%s in the [%s] section failed: %s %s", name, commandSuffix, section.Name(), err.Error(), strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	if path := keys[name+fileSuffix]; len(path) > 0 {
+		content, err := ioutil.ReadFile(expandHome(path))
+		if err != nil {
+			return "", fmt.Errorf("%s%s in the [%s] section not readable at %s", name, fileSuffix, section.Name(), path)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return strings.TrimSpace(keys[name]), nil
+}
+
+// Site gets the Datadog site (e.g., us1, eu, us5 or datadoghq.eu) from the config file. Defaults to an empty string.
+func (c *IniFile) Site() string {
+	return c.serverKey("site").MustString("")
+}
+
+// ApiUrl gets a custom base URL for the Datadog API from the config file. Overrides the site when present, which is
+// mainly useful to point at a local stub server. Defaults to an empty string.
+func (c *IniFile) ApiUrl() string {
+	return c.serverKey("api-url").MustString("")
+}
+
+// Query gets the default query from the config file, used when no query is given on the command-line. Defaults to an
+// empty string.
+func (c *IniFile) Query() string {
+	return c.serverKey("query").MustString("")
+}
+
+// Indexes gets the log indexes to search from the comma separated 'indexes' key. Empty for the default index.
+func (c *IniFile) Indexes() []string {
+	var indexes []string
+	for _, index := range c.serverKey("indexes").Strings(",") {
+		if len(index) > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// ApiVersion gets the version of the Datadog log API to call from the config file. Defaults to the v2 API, 'v1'
+// selects the deprecated log list API.
+func (c *IniFile) ApiVersion() string {
+	return c.serverKey("api-version").In(ApiVersion2, []string{ApiVersion1, ApiVersion2})
+}
+
+// Timeout gets the timeout of a single call to Datadog from the config file, e.g., 30s. Defaults to DefaultTimeout.
+func (c *IniFile) Timeout() time.Duration {
+	section := c.ini.Section(httpSection)
+	return section.Key("timeout").MustDuration(DefaultTimeout)
+}
+
+// Proxy gets the proxy URL from the config file. Defaults to an empty string.
+func (c *IniFile) Proxy() string {
+	section := c.ini.Section(httpSection)
+	return section.Key("proxy").MustString("")
+}
+
+// CaFile gets the path of a PEM file with extra CA certificates from the config file. Defaults to an empty string.
+func (c *IniFile) CaFile() string {
+	section := c.ini.Section(httpSection)
+	return section.Key("ca-file").MustString("")
+}
+
+// InsecureSkipVerify gets whether TLS certificate verification is skipped from the config file. Defaults to false.
+func (c *IniFile) InsecureSkipVerify() bool {
+	section := c.ini.Section(httpSection)
+	return section.Key("insecure-skip-verify").MustBool(false)
+}
+
+// Formats gets the log messages formats from the config file. The formats of the selected profile come first, followed
+// by the global formats they don't override. Adds a final default format case so the user knows that no formats were
+// applied successfully.
 func (c *IniFile) Formats() (formats []FormatDefinition) {
-	if storedFormats == nil {
-		for _, f := range c.ini.Section(formatsSection).Keys() {
-			formats = append(formats, FormatDefinition{Name: f.Name(), Format: f.Value()})
+	if c.storedFormats == nil {
+		overridden := make(map[string]bool)
+		if section := c.profileOverride(formatsSection); section != nil {
+			for _, f := range readFormats(section) {
+				formats = append(formats, f)
+				overridden[f.Name] = true
+			}
+		}
+		for _, f := range readFormats(c.ini.Section(formatsSection)) {
+			if !overridden[f.Name] {
+				formats = append(formats, f)
+			}
 		}
 		formats = append(formats, FormatDefinition{Name: "_default", Format: NoFormatDefined + " {{._json}}"})
-		storedFormats = formats
+		c.storedFormats = formats
 	}
 
-	return storedFormats
+	return c.storedFormats
+}
+
+// Read the formats of a single section, in order, attaching the '<name>.match' rules to their formats.
+func readFormats(section *ini.Section) (formats []FormatDefinition) {
+	matches := make(map[string]string)
+	for _, f := range section.Keys() {
+		if strings.HasSuffix(f.Name(), MatchSuffix) {
+			matches[strings.TrimSuffix(f.Name(), MatchSuffix)] = f.Value()
+		} else {
+			formats = append(formats, FormatDefinition{Name: f.Name(), Format: f.Value()})
+		}
+	}
+	for i := range formats {
+		formats[i].Match = matches[formats[i].Name]
+	}
+	return formats
 }
 
-// Fields gets the field mappings from the config file. These will be merged with the defaults.
+// Fields gets the field mappings from the config file. These will be merged with the defaults, the mappings of the
+// selected profile win over the global ones.
 func (c *IniFile) Fields() (fields map[string][]string) {
-	if storedFields == nil {
-		storedFields = make(map[string][]string)
-		storedFields[LevelField] = []string{"level", "status", "loglevel", "log_status"}
-		storedFields[MessageField] = []string{"message", "msg"}
-		storedFields[FullMessageField] = []string{"full_message", "original_message"}
-		storedFields[ClassnameField] = []string{"logger_name"}
-		for _, f := range c.ini.Section(fieldSection).Keys() {
-			name := f.Name()
-			value := f.Value()
-			fieldList := strings.Split(value, ",")
-			for i := range fieldList {
-				fieldList[i] = strings.TrimSpace(fieldList[i])
+	if c.storedFields == nil {
+		c.storedFields = make(map[string][]string)
+		c.storedFields[LevelField] = []string{"level", "status", "loglevel", "log_status"}
+		c.storedFields[MessageField] = []string{"message", "msg"}
+		c.storedFields[FullMessageField] = []string{"full_message", "original_message"}
+		c.storedFields[ClassnameField] = []string{"logger_name"}
+		sections := []*ini.Section{c.ini.Section(fieldSection)}
+		if section := c.profileOverride(fieldSection); section != nil {
+			sections = append(sections, section)
+		}
+		for _, section := range sections {
+			for _, f := range section.Keys() {
+				name := f.Name()
+				value := f.Value()
+				fieldList := strings.Split(value, ",")
+				for i := range fieldList {
+					fieldList[i] = strings.TrimSpace(fieldList[i])
+				}
+				c.storedFields[name] = fieldList
 			}
-			storedFields[name] = fieldList
 		}
 	}
 
-	return storedFields
+	return c.storedFields
+}
+
+// Colors returns the color specifications of the [colors] section, e.g., 'error = bold red', overridden by the
+// [colors.<profile>] section. Keys are level names or template field names without their '_' prefix.
+func (c *IniFile) Colors() map[string]string {
+	colors := make(map[string]string)
+	sections := []*ini.Section{c.ini.Section(colorsSection)}
+	if section := c.profileOverride(colorsSection); section != nil {
+		sections = append(sections, section)
+	}
+	for _, section := range sections {
+		for _, key := range section.Keys() {
+			colors[key.Name()] = strings.TrimSpace(key.Value())
+		}
+	}
+	return colors
 }
 
 // Pull a field from the 'fields' map, using field mappings as available
@@ -111,6 +381,16 @@ func (c *IniFile) MapField(fields map[string]string, field string) (string, bool
 	}
 }
 
+// Expand a leading tilde (~) in a file path into the user's home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
 // Reads the configuration file. The configuration is stored in a INI style file.
 func readConfig(configPath string) (cfg *ini.File, err error) {
 	configPath, err = filepath.Abs(configPath)
@@ -124,7 +404,7 @@ func readConfig(configPath string) (cfg *ini.File, err error) {
 
 	cfg, err = ini.Load(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("configuration file cannot be parsed at %s", configPath)
+		return nil, fmt.Errorf("configuration file cannot be parsed at %s: %s", configPath, err.Error())
 	}
 
 	return cfg, nil
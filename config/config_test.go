@@ -0,0 +1,298 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+const profilesConfig = `
+[server]
+api-key = global-api
+application-key = global-app
+query = env:prod
+
+[server.staging]
+api-key = staging-api
+query = env:staging
+
+[profile eu]
+api-key = eu-api
+application-key = eu-app
+site = eu
+
+[formats]
+plain = {{.message}}
+full = {{.host}} {{.message}}
+full.match = service=web
+
+[formats.staging]
+full = {{.service}} {{.message}}
+extra = {{.service}}
+
+[fields]
+message = msg
+
+[fields.staging]
+level = severity
+`
+
+// Write a config file and load it with a profile.
+func load(t *testing.T, content string, profile string) (*IniFile, error) {
+	path := filepath.Join(t.TempDir(), "doglog.ini")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return New(path, profile)
+}
+
+// Resolve both keys, ignoring errors.
+func keys(c *IniFile) (string, string) {
+	apiKey, _ := c.ApiKey()
+	applicationKey, _ := c.ApplicationKey()
+	return apiKey, applicationKey
+}
+
+// Clear the key environment variables for the duration of a test.
+func clearKeyEnv(t *testing.T) {
+	t.Setenv(ApiKeyEnv, "")
+	t.Setenv(ApplicationKeyEnv, "")
+	t.Setenv(ApplicationKeyAltEnv, "")
+}
+
+func TestProfiles(t *testing.T) {
+	clearKeyEnv(t)
+	c, err := load(t, profilesConfig, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey, _ := keys(c); apiKey != "global-api" || c.Query() != "env:prod" || c.Site() != "" {
+		t.Errorf("no profile: %s, %s, %s", apiKey, c.Query(), c.Site())
+	}
+	if profiles := c.Profiles(); len(profiles) != 2 || profiles[0] != "staging" || profiles[1] != "eu" {
+		t.Errorf("Profiles() = %v", profiles)
+	}
+
+	c, _ = load(t, profilesConfig, "staging")
+	if apiKey, applicationKey := keys(c); apiKey != "staging-api" || applicationKey != "global-app" || c.Query() != "env:staging" {
+		t.Errorf("staging: %s, %s, %s", apiKey, applicationKey, c.Query())
+	}
+
+	c, _ = load(t, profilesConfig, "eu")
+	if apiKey, applicationKey := keys(c); apiKey != "eu-api" || applicationKey != "eu-app" || c.Site() != "eu" || c.Query() != "env:prod" {
+		t.Errorf("eu: %s, %s, %s, %s", apiKey, applicationKey, c.Site(), c.Query())
+	}
+
+	if _, err = load(t, profilesConfig, "missing"); err == nil {
+		t.Errorf("a missing profile should fail")
+	}
+}
+
+func TestProfileFormatsAndFields(t *testing.T) {
+	c, _ := load(t, profilesConfig, "staging")
+
+	var names []string
+	for _, f := range c.Formats() {
+		names = append(names, f.Name+"="+f.Format)
+		if len(f.Match) > 0 {
+			t.Errorf("format %s shouldn't have a match rule: %s", f.Name, f.Match)
+		}
+	}
+	expected := []string{"full={{.service}} {{.message}}", "extra={{.service}}", "plain={{.message}}",
+		"_default=" + NoFormatDefined + " {{._json}}"}
+	if len(names) != len(expected) {
+		t.Fatalf("Formats() = %v", names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Formats()[%d] = %s", i, names[i])
+		}
+	}
+
+	fields := c.Fields()
+	if fields[LevelField][0] != "severity" || fields[MessageField][0] != "msg" || fields[ClassnameField][0] != "logger_name" {
+		t.Errorf("Fields() = %v", fields)
+	}
+}
+
+func TestKeyPrecedence(t *testing.T) {
+	clearKeyEnv(t)
+	keyFile := filepath.Join(t.TempDir(), "app-key")
+	if err := ioutil.WriteFile(keyFile, []byte("file-app\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content := "[server]\napi-key = plain-api\napi-key-command = echo command-api\n" +
+		"application-key = plain-app\napplication-key-file = " + keyFile + "\n"
+
+	c, _ := load(t, content, "")
+	if apiKey, applicationKey := keys(c); apiKey != "command-api" || applicationKey != "file-app" {
+		t.Errorf("command and file: %s, %s", apiKey, applicationKey)
+	}
+
+	// A profile's own key wins over a command or file in the [server] section
+	profiles := "[server]\napi-key-command = echo global\napplication-key = global-app\n" +
+		"[server.eu]\napi-key = eu-key\n[profile us]\napi-key = us-key\n"
+	for profile, want := range map[string]string{"eu": "eu-key", "us": "us-key", "": "global"} {
+		c, _ = load(t, profiles, profile)
+		if apiKey, applicationKey := keys(c); apiKey != want || applicationKey != "global-app" {
+			t.Errorf("profile %q: %s, %s", profile, apiKey, applicationKey)
+		}
+	}
+
+	t.Setenv(ApiKeyEnv, "env-api")
+	t.Setenv(ApplicationKeyAltEnv, "env-app")
+	c, _ = load(t, content, "")
+	if apiKey, applicationKey := keys(c); apiKey != "env-api" || applicationKey != "env-app" {
+		t.Errorf("environment: %s, %s", apiKey, applicationKey)
+	}
+}
+
+func TestKeyErrors(t *testing.T) {
+	clearKeyEnv(t)
+	c, _ := load(t, "[server]\napi-key-command = exit 3\n", "")
+	if _, err := c.ApiKey(); err == nil {
+		t.Errorf("a failing command should be an error")
+	}
+	if _, err := c.ApplicationKey(); err == nil {
+		t.Errorf("a missing key should be an error")
+	}
+
+	// The errors name the section the key was read from
+	c, _ = load(t, "[server]\napi-key = a\n[server.eu]\napi-key-command = exit 3\n", "eu")
+	if _, err := c.ApiKey(); err == nil || !strings.Contains(err.Error(), "[server.eu]") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := c.ApplicationKey(); err == nil || !strings.Contains(err.Error(), "[server.eu] or [server]") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	clearKeyEnv(t)
+	content := `stray = 1
+[server]
+api-key = a
+application-key = b
+api-version = v3
+colour = red
+
+[server.prod]
+api-key = c
+
+[formats]
+good = {{.host}} {{upper .message}}
+broken = {{.host}
+unknownFunc = {{nope .host}}
+brace = {._magenta}}{{.service}}
+brace.match = service=api
+orphan.match = bad
+
+[formats.missing]
+x = {{.host}}
+
+[http]
+timeout = soon
+
+[extras]
+
+[colors]
+error = bold red
+http-status = 208
+warn = sparkly
+
+[http.prod]
+timeout = 5s
+`
+	path := filepath.Join(t.TempDir(), "doglog.ini")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	funcs := template.FuncMap{"upper": strings.ToUpper}
+	validateMatch := func(expr string) error {
+		if strings.Contains(expr, "=") {
+			return nil
+		}
+		return errors.New("bad rule")
+	}
+	validateColor := func(spec string) error {
+		if spec == "sparkly" {
+			return errors.New("unknown color")
+		}
+		return nil
+	}
+	diagnostics, err := Check(path, funcs, validateMatch, validateColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"1: warning: key stray is outside of any section",
+		"5: error: api-version must be v1 or v2, not v3",
+		"6: warning: unknown key colour in section [server]",
+		"13: error: format broken doesn't parse",
+		"14: error: format unknownFunc doesn't parse",
+		"15: warning: format brace has a single '{' before a field ({._magenta)",
+		"17: warning: match rule orphan.match has no format orphan",
+		"17: error: match rule orphan.match: bad rule",
+		"19: warning: section [formats.missing] belongs to profile missing, which isn't defined",
+		"23: error: timeout can't be parsed",
+		"25: warning: unknown section [extras]",
+		"29: warning: color http-status can't be used in templates",
+		"30: error: color warn: unknown color",
+		"32: warning: unknown section [http.prod]",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("Check() = %v", diagnostics)
+	}
+	for i, d := range diagnostics {
+		if !strings.HasPrefix(d.String(), expected[i]) {
+			t.Errorf("diagnostic %d = %s, expected %s", i, d.String(), expected[i])
+		}
+	}
+}
+
+func TestCheckMissingKeys(t *testing.T) {
+	clearKeyEnv(t)
+	path := filepath.Join(t.TempDir(), "doglog.ini")
+	if err := ioutil.WriteFile(path, []byte("[server]\napi-key = a\n\n[profile eu]\nsite = eu\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	diagnostics, _ := Check(path, template.FuncMap{}, func(string) error { return nil }, func(string) error { return nil })
+	if len(diagnostics) != 2 || diagnostics[0].Line != 1 || diagnostics[1].Line != 4 {
+		t.Errorf("Check() = %v", diagnostics)
+	}
+
+	// Without a [server] section only the profiles need the keys
+	if err := ioutil.WriteFile(path, []byte("[profile prod]\napi-key = a\napplication-key = b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics, _ = Check(path, template.FuncMap{}, func(string) error { return nil }, func(string) error { return nil }); len(diagnostics) != 0 {
+		t.Errorf("Check() = %v", diagnostics)
+	}
+}
+
+func TestFormatMatchRules(t *testing.T) {
+	c, _ := load(t, profilesConfig, "")
+	formats := c.Formats()
+	if formats[0].Name != "plain" || formats[0].Match != "" || formats[1].Name != "full" || formats[1].Match != "service=web" {
+		t.Errorf("Formats() = %+v", formats)
+	}
+	if len(formats) != 3 {
+		t.Errorf("match rules shouldn't be formats: %+v", formats)
+	}
+}
+
+func TestColors(t *testing.T) {
+	content := profilesConfig + "\n[colors]\nerror = bold red\nhost = 208\n\n[colors.staging]\nhost = rgb:ff8800\n"
+	c, _ := load(t, content, "staging")
+	if colors := c.Colors(); colors["error"] != "bold red" || colors["host"] != "rgb:ff8800" {
+		t.Errorf("Colors() = %v", colors)
+	}
+	c, _ = load(t, content, "")
+	if colors := c.Colors(); colors["host"] != "208" {
+		t.Errorf("Colors() = %v", colors)
+	}
+}
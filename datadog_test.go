@@ -1,9 +1,20 @@
 package main
 
 import (
+	"./config"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func ExampleExpand() {
@@ -23,3 +34,1052 @@ func TestExpandPath(t *testing.T) {
 		t.Errorf("expandPath(\"~/.datadog\") = %s", path1)
 	}
 }
+
+func TestDatadogBaseUri(t *testing.T) {
+	tests := []struct {
+		site    string
+		baseUrl string
+		want    string
+	}{
+		{"", "", "https://api.datadoghq.com"},
+		{"eu", "", "https://api.datadoghq.eu"},
+		{"US5", "", "https://api.us5.datadoghq.com"},
+		{"ap1.datadoghq.com", "", "https://api.ap1.datadoghq.com"},
+		{"gov", "", "https://api.ddog-gov.com"},
+		{"eu", "http://127.0.0.1:8080/", "http://127.0.0.1:8080"},
+	}
+	for _, test := range tests {
+		got, err := datadogBaseUri(test.site, test.baseUrl)
+		if err != nil || got != test.want {
+			t.Errorf("datadogBaseUri(%q, %q) = %s, %v", test.site, test.baseUrl, got, err)
+		}
+	}
+
+	if _, err := datadogBaseUri("mars", ""); err == nil {
+		t.Errorf("datadogBaseUri(\"mars\", \"\") should fail")
+	}
+}
+
+// Create options that point at a local stub server.
+func stubOptions(t *testing.T, server *httptest.Server, settings string) *options {
+	path := filepath.Join(t.TempDir(), "doglog.ini")
+	content := "[server]\napi-key = test-api-key\napplication-key = test-app-key\napi-url = " + server.URL + "\n" + settings
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.New(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiUri, _ := datadogBaseUri("", cfg.ApiUrl())
+	client, err := newHttpClient(clientSettings{timeout: cfg.Timeout()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &options{limit: DefaultLimit, timeRange: 3600, serverConfig: cfg, apiUri: apiUri, client: client}
+}
+
+func TestFetchMessagesV2(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != logsSearchV2Path {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get(apiKeyHeader) != "test-api-key" || r.Header.Get(applicationKeyHeader) != "test-app-key" {
+			t.Errorf("missing key headers: %v", r.Header)
+		}
+		if len(r.URL.RawQuery) > 0 || r.Header.Get("Content-Type") != jsonContentType {
+			t.Errorf("unexpected query %s or content type %s", r.URL.RawQuery, r.Header.Get("Content-Type"))
+		}
+		_, _ = w.Write([]byte(`{"data":[{"id":"AAA","type":"log","attributes":{"timestamp":"2019-10-03T13:22:52.882Z",
+			"service":"api","message":"hello","tags":["env:prod"],"attributes":{"http":{"status_code":200}}}}],
+			"meta":{"page":{"after":"cursor-2"},"status":"done"}}`))
+	}))
+	defer server.Close()
+
+	messages, cursor, err := fetchMessages(stubOptions(t, server, ""), searchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "cursor-2" {
+		t.Errorf("cursor = %s", cursor)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("len(messages) = %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.id != "AAA" || msg.fields["service"] != "api" || msg.fields["http_status_code"] != "200" || msg.tags[0] != "env:prod" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	headers := map[string]string{apiKeyHeader: "secret1", applicationKeyHeader: "secret2"}
+	got := redactKeys("Post https://host/?a=secret1&b=secret2: timeout", headers)
+	if got != "Post https://host/?a=<redacted>&b=<redacted>: timeout" {
+		t.Errorf("redactKeys() = %s", got)
+	}
+}
+
+func TestMessageAPIBodyQuoting(t *testing.T) {
+	queries := []string{
+		`@msg:"connection reset"`,
+		`path:C:\temp\logs`,
+		`service:api "quoted \"inner\" text"`,
+		"tab\tand\nnewline",
+	}
+	for _, query := range queries {
+		search := newSearchRequest(&options{query: query, timeRange: 60}, "")
+
+		var v1 logsListRequestV1
+		if err := json.Unmarshal([]byte(messageAPIBodyV1(search)), &v1); err != nil || v1.Query != query {
+			t.Errorf("v1 body for %q: %v, %q", query, err, v1.Query)
+		}
+		if v1.StartAt != nil || v1.Time.From != "now - 60s" || v1.Sort != sortAsc || v1.Limit != DefaultLimit {
+			t.Errorf("unexpected v1 body %+v", v1)
+		}
+
+		var v2 logsSearchRequestV2
+		if err := json.Unmarshal([]byte(messageAPIBodyV2(search)), &v2); err != nil || v2.Filter.Query != query {
+			t.Errorf("v2 body for %q: %v, %q", query, err, v2.Filter.Query)
+		}
+	}
+}
+
+func TestMessageAPIBodyPaging(t *testing.T) {
+	start := time.Date(2019, 1, 4, 12, 30, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	search := newSearchRequest(&options{limit: 50, startDate: &start, endDate: &end, sort: sortDesc}, "next-page")
+	search.indexes = []string{"main", "audit"}
+
+	var v1 logsListRequestV1
+	_ = json.Unmarshal([]byte(messageAPIBodyV1(search)), &v1)
+	if v1.Query != "*" || v1.StartAt == nil || *v1.StartAt != "next-page" || v1.Limit != 50 || v1.Index != "main" ||
+		v1.Time.From != "2019-01-04T12:30:00.000Z" || v1.Time.To != "2019-01-04T13:30:00.000Z" {
+		t.Errorf("unexpected v1 body %+v", v1)
+	}
+
+	var v2 logsSearchRequestV2
+	_ = json.Unmarshal([]byte(messageAPIBodyV2(search)), &v2)
+	if v2.Page.Cursor != "next-page" || v2.Page.Limit != 50 || v2.Sort != sortDescV2 || len(v2.Filter.Indexes) != 2 ||
+		v2.Filter.From != "2019-01-04T12:30:00.000Z" || v2.Filter.To != "2019-01-04T13:30:00.000Z" {
+		t.Errorf("unexpected v2 body %+v", v2)
+	}
+}
+
+func TestFetchMessagesErrors(t *testing.T) {
+	retrySleep = func(time.Duration) {}
+	defer func() { retrySleep = time.Sleep }()
+
+	tests := []struct {
+		status    int
+		body      string
+		kind      apiErrorKind
+		temporary bool
+	}{
+		{http.StatusForbidden, `{"errors":["Forbidden"]}`, authError, false},
+		{http.StatusTooManyRequests, `{"errors":["Rate limit exceeded"]}`, rateLimitError, true},
+		{http.StatusBadGateway, `<html>Bad Gateway</html>`, serverError, true},
+		{http.StatusBadRequest, `{"errors":["invalid query"]}`, requestError, false},
+		{http.StatusOK, `{"data":[`, malformedError, true},
+		{http.StatusOK, `{"meta":{}}`, malformedError, true},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			_, _ = w.Write([]byte(test.body))
+		}))
+
+		_, _, err := fetchMessages(stubOptions(t, server, ""), searchRequest{})
+		var e *apiError
+		if !errors.As(err, &e) || e.kind != test.kind || e.temporary() != test.temporary {
+			t.Errorf("status %d, body %s: unexpected error %v", test.status, test.body, err)
+		}
+		server.Close()
+	}
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	var waits []time.Duration
+	retrySleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { retrySleep = time.Sleep }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set(rateLimitLimitHeader, "300")
+		w.Header().Set(rateLimitPeriodHeader, "3600")
+		w.Header().Set(rateLimitResetHeader, "0")
+		if calls == 1 {
+			w.Header().Set(rateLimitRemainingHeader, "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set(rateLimitRemainingHeader, "299")
+		_, _ = w.Write([]byte(`{"data":[],"meta":{"status":"done"}}`))
+	}))
+	defer server.Close()
+
+	if _, _, err := fetchMessages(stubOptions(t, server, ""), searchRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(waits) != 1 || waits[0] >= time.Second {
+		t.Errorf("calls = %d, waits = %v", calls, waits)
+	}
+	if lastRateLimit != (rateLimit{known: true, limit: 300, remaining: 299, reset: 0, period: 3600}) {
+		t.Errorf("lastRateLimit = %+v", lastRateLimit)
+	}
+}
+
+func TestRateLimitRetryWithoutHeaders(t *testing.T) {
+	var waits []time.Duration
+	retrySleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { retrySleep = time.Sleep }()
+
+	// A stale budget from an earlier call must not be used for a 429 without headers
+	lastRateLimit = rateLimit{known: true, limit: 300, remaining: 0, reset: 3000, period: 3600}
+	defer func() { lastRateLimit = rateLimit{} }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":[],"meta":{"status":"done"}}`))
+	}))
+	defer server.Close()
+
+	if _, _, err := fetchMessages(stubOptions(t, server, ""), searchRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || len(waits) != 2 || waits[0] >= 2*time.Second || waits[1] < 2*time.Second || waits[1] >= 3*time.Second {
+		t.Errorf("calls = %d, waits = %v", calls, waits)
+	}
+}
+
+func TestRateLimitMaxWait(t *testing.T) {
+	var waits []time.Duration
+	retrySleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { retrySleep = time.Sleep }()
+
+	// The budget resets too far in the future to wait for it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(rateLimitLimitHeader, "300")
+		w.Header().Set(rateLimitRemainingHeader, "0")
+		w.Header().Set(rateLimitResetHeader, "3000")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	_, _, err := fetchMessages(stubOptions(t, server, ""), searchRequest{})
+	var e *apiError
+	if !errors.As(err, &e) || e.kind != rateLimitError || len(waits) != 0 {
+		t.Errorf("err = %v, waits = %v", err, waits)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	budget := rateLimit{known: true, limit: 300, remaining: 9, reset: 600, period: 3600}
+	if delay := rateLimitDelay(minDelay, budget); delay != 60 {
+		t.Errorf("rateLimitDelay() = %f", delay)
+	}
+	budget.remaining = 100
+	if delay := rateLimitDelay(minDelay, budget); delay != minDelay {
+		t.Errorf("rateLimitDelay() = %f", delay)
+	}
+}
+
+func TestHttpClientTimeout(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	opts := stubOptions(t, server, "[http]\ntimeout = 50ms\n")
+	_, _, err := fetchMessages(opts, newSearchRequest(opts, ""))
+	var e *apiError
+	if !errors.As(err, &e) || e.kind != networkError {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCommandListMessagesPaging(t *testing.T) {
+	var requests []logsSearchRequestV2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request logsSearchRequestV2
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		page := len(requests)
+		_, _ = fmt.Fprintf(w, `{"data":[
+			{"id":"page-%d-1","attributes":{"timestamp":"2019-10-03T13:22:5%d.000Z","message":"one"}},
+			{"id":"page-%d-2","attributes":{"timestamp":"2019-10-03T13:22:5%d.500Z","message":"two"}}],
+			"meta":{"page":{"after":"cursor-%d"}}}`, page, page, page, page, page)
+	}))
+	defer server.Close()
+
+	opts := stubOptions(t, server, "[formats]\nplain = {{._message_text}}\n")
+	opts.limit = 2
+	opts.maxResults = 5
+	found, err := commandListMessages(opts, nil, nil)
+	if !found || err != nil {
+		t.Fatalf("commandListMessages() = %v, %v", found, err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("requests = %d", len(requests))
+	}
+	if requests[0].Page.Cursor != "" || requests[1].Page.Cursor != "cursor-1" || requests[2].Page.Cursor != "cursor-2" {
+		t.Errorf("cursors not threaded: %+v", requests)
+	}
+	if requests[2].Page.Limit != 1 {
+		t.Errorf("last page limit = %d", requests[2].Page.Limit)
+	}
+}
+
+func TestTailTracker(t *testing.T) {
+	base := time.Date(2019, 10, 3, 13, 22, 0, 0, time.UTC)
+	message := func(id string, offset time.Duration) logMessage {
+		return logMessage{id: id, timestamp: base.Add(offset)}
+	}
+	tracker := newTailTracker(30 * time.Second)
+
+	// The first poll fetches a single page of the relative range, newest first
+	search := newSearchRequest(&options{timeRange: 60}, "")
+	if !tracker.narrow(&search) || !search.relative() || search.sort != sortDesc {
+		t.Errorf("first poll should be a single relative and descending page: %+v", search)
+	}
+	fresh := tracker.filter([]logMessage{message("a", 0), message("b", time.Second), message("c", time.Second)})
+	tracker.done()
+	if len(fresh) != 3 || tracker.mark != base.Add(time.Second) {
+		t.Errorf("first poll: %d fresh, mark %s", len(fresh), tracker.mark)
+	}
+
+	// Later polls start from the mark minus the overlap, and only output unseen messages (including late arrivals)
+	search = newSearchRequest(&options{timeRange: 60}, "")
+	if tracker.narrow(&search) || search.relative() || search.sort != sortAsc || !search.start.Equal(base.Add(time.Second-tracker.overlap)) {
+		t.Errorf("second poll window: %+v", search)
+	}
+	fresh = tracker.filter([]logMessage{message("b", time.Second), message("late", 500*time.Millisecond),
+		message("c", time.Second), message("d", time.Minute)})
+	tracker.done()
+	if len(fresh) != 2 || fresh[0].id != "late" || fresh[1].id != "d" || tracker.mark != base.Add(time.Minute) {
+		t.Errorf("second poll: %+v, mark %s", fresh, tracker.mark)
+	}
+
+	// Ids that fell out of the overlap window are forgotten
+	if _, ok := tracker.seen["a"]; ok || len(tracker.seen) != 1 {
+		t.Errorf("seen = %v", tracker.seen)
+	}
+}
+
+func TestTailStartsWithNewestPage(t *testing.T) {
+	var requests []logsSearchRequestV2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request logsSearchRequestV2
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		_, _ = w.Write([]byte(`{"data":[
+			{"id":"m3","attributes":{"timestamp":"2019-10-03T13:22:53.000Z","message":"three"}},
+			{"id":"m2","attributes":{"timestamp":"2019-10-03T13:22:52.000Z","message":"two"}}],
+			"meta":{"page":{"after":"cursor-2"}}}`))
+	}))
+	defer server.Close()
+
+	opts := stubOptions(t, server, "[formats]\nplain = {{._message_text}}\n")
+	opts.tail = true
+	opts.limit = 2
+	tracker := newTailTracker(30 * time.Second)
+	out := captureStdout(t, func() {
+		if _, err := commandListMessages(opts, nil, tracker); err != nil {
+			t.Error(err)
+		}
+	})
+	if len(requests) != 1 || requests[0].Sort != sortDescV2 {
+		t.Errorf("the first poll should fetch a single descending page: %+v", requests)
+	}
+	if out != "two\nthree\n" || !tracker.mark.Equal(time.Date(2019, 10, 3, 13, 22, 53, 0, time.UTC)) {
+		t.Errorf("output %q, mark %s", out, tracker.mark)
+	}
+}
+
+func TestTailSubSecondWindow(t *testing.T) {
+	// Three messages a few hundred milliseconds past the second, the last two arrive after the first poll
+	timestamps := map[string]string{"a": "2019-10-03T13:22:00.200Z", "b": "2019-10-03T13:22:01.200Z", "c": "2019-10-03T13:22:31.500Z"}
+	visible := [][]string{{"a"}, {"a", "b", "c"}, {"a", "b", "c"}}
+	poll := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request logsSearchRequestV2
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		from, err := time.Parse(time.RFC3339Nano, request.Filter.From)
+		var data []string
+		for _, id := range visible[poll] {
+			ts, _ := time.Parse(time.RFC3339Nano, timestamps[id])
+			if err != nil || !ts.Before(from) {
+				data = append(data, fmt.Sprintf(`{"id":"%s","attributes":{"timestamp":"%s","message":"%s"}}`, id, timestamps[id], id))
+			}
+		}
+		poll++
+		_, _ = fmt.Fprintf(w, `{"data":[%s],"meta":{"status":"done"}}`, strings.Join(data, ","))
+	}))
+	defer server.Close()
+
+	opts := stubOptions(t, server, "[formats]\nplain = {{._message_text}}\n")
+	opts.tail = true
+	tracker := newTailTracker(30 * time.Second)
+	out := captureStdout(t, func() {
+		for range visible {
+			if _, err := commandListMessages(opts, nil, tracker); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	if out != "a\nb\nc\n" {
+		t.Errorf("output %q", out)
+	}
+}
+
+func TestTailSurvivesBadPoll(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls == 1 {
+			_, _ = w.Write([]byte(`{"data":[`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":[{"id":"AAA","attributes":{"timestamp":"2019-10-03T13:22:52.882Z","message":"hello"}}],
+			"meta":{"status":"done"}}`))
+	}))
+	defer server.Close()
+
+	opts := stubOptions(t, server, "[formats]\nplain = {{._message_text}}\n")
+	tracker := newTailTracker(30 * time.Second)
+
+	// The malformed response fails the poll, but the tail carries on
+	_, err := commandListMessages(opts, nil, tracker)
+	if err == nil || !tracker.failed(err) {
+		t.Fatalf("first poll: %v", err)
+	}
+	out := captureStdout(t, func() {
+		if found, err := commandListMessages(opts, nil, tracker); !found || err != nil {
+			t.Errorf("second poll: %v, %v", found, err)
+		}
+	})
+	if out != "hello\n" || tracker.failures != 0 {
+		t.Errorf("second poll output %q, failures %d", out, tracker.failures)
+	}
+
+	// Only failures in a row stop the tail, and bad keys stop it straight away
+	for i := 1; i < maxTailFailures; i++ {
+		if !tracker.failed(newMalformedError("invalid JSON")) {
+			t.Errorf("gave up after %d failures", i)
+		}
+	}
+	if tracker.failed(newMalformedError("invalid JSON")) {
+		t.Errorf("should give up after %d failures", maxTailFailures)
+	}
+	if newTailTracker(30 * time.Second).failed(&apiError{kind: authError}) {
+		t.Errorf("should give up on bad keys")
+	}
+}
+
+func TestCompiledFormats(t *testing.T) {
+	formats := compileFormats([]config.FormatDefinition{
+		{Name: "broken", Format: "{{.host}"},
+		{Name: "with_host", Format: "{{.host}} {{.message}}"},
+		{Name: "message", Format: "{{.message | upper}}"},
+	})
+	if len(formats) != 2 {
+		t.Fatalf("broken formats should be skipped: %d", len(formats))
+	}
+	messages := []map[string]string{{"host": "h1", "message": "m1"}, {"message": "m2"}, {"message": "m3"}}
+	var output []string
+	for _, fields := range messages {
+		for _, f := range formats {
+			if text := tryFormat(logMessage{fields: fields}, f); len(text) > 0 {
+				output = append(output, text)
+				break
+			}
+		}
+	}
+	if strings.Join(output, ",") != "h1 m1,M2,M3" || formats[0].hits != 1 || formats[1].hits != 2 {
+		t.Errorf("output = %v, hits = %d, %d", output, formats[0].hits, formats[1].hits)
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	fields := map[string]string{"service": "api-gateway", "_level": "ERROR", "host": "web-12", "http_status_code": "503",
+		"message": "timeout and retry", "zone": "eu,west"}
+	tests := []struct {
+		rule    string
+		matches bool
+	}{
+		{"", true},
+		{"service=api-gateway", true},
+		{"service = \"api-gateway\"", true},
+		{"service!=api-gateway", false},
+		{"_level in (ERROR, FATAL)", true},
+		{"_level NOT IN (ERROR,FATAL)", false},
+		{"host~^web-[0-9]+$", true},
+		{"host!~^web-", false},
+		{"@http.status_code in (500,502,503) AND service=api-gateway", true},
+		{"service=api-gateway && _level=WARN", false},
+		{"missing=x", false},
+		{"missing!=x", true},
+		{"message=\"timeout and retry\" AND service=api-gateway", true},
+		{"message~`^timeout and \\w+$` && host~web", true},
+		{"message~\"timeout && retry\"", false},
+		{"zone in (\"eu,west\", us)", true},
+		{"zone in (eu, west)", false},
+	}
+	for _, test := range tests {
+		rule, err := parseMatchRule(test.rule)
+		if err != nil {
+			t.Errorf("parseMatchRule(%q) failed: %s", test.rule, err.Error())
+		} else if rule.matches(fields) != test.matches {
+			t.Errorf("parseMatchRule(%q).matches() = %v", test.rule, !test.matches)
+		}
+	}
+
+	for _, bad := range []string{"service", "host~[", "service=a AND", "message~timeout and retry"} {
+		if _, err := parseMatchRule(bad); err == nil {
+			t.Errorf("parseMatchRule(%q) should fail", bad)
+		}
+	}
+}
+
+func TestFormatSelectionWithRules(t *testing.T) {
+	formats := compileFormats([]config.FormatDefinition{
+		{Name: "errors", Format: "E {{.message}}", Match: "_level in (ERROR,FATAL)"},
+		{Name: "gateway", Format: "G {{.message}}", Match: "service=api-gateway"},
+		{Name: "any", Format: "A {{.message}}"},
+	})
+	apply := func(fields map[string]string) string {
+		for _, f := range formats {
+			if text := tryFormat(logMessage{fields: fields}, f); len(text) > 0 {
+				return text
+			}
+		}
+		return ""
+	}
+	if text := apply(map[string]string{"service": "api-gateway", "_level": "ERROR", "message": "m"}); text != "E m" {
+		t.Errorf("error message used %s", text)
+	}
+	if text := apply(map[string]string{"service": "api-gateway", "_level": "INFO", "message": "m"}); text != "G m" {
+		t.Errorf("gateway message used %s", text)
+	}
+	if text := apply(map[string]string{"service": "other", "message": "m"}); text != "A m" {
+		t.Errorf("other message used %s", text)
+	}
+}
+
+func TestNamedAndAdHocFormats(t *testing.T) {
+	definitions := []config.FormatDefinition{
+		{Name: "short", Format: "{{.message}}", Match: "service=never"},
+		{Name: "broken", Format: "{{.message}"},
+	}
+	formats, err := namedFormat(definitions, "short")
+	if err != nil || len(formats) != 1 || len(formats[0].rule) != 0 {
+		t.Fatalf("namedFormat() = %v, %v", formats, err)
+	}
+	if text := tryFormat(logMessage{fields: map[string]string{"message": "m"}}, formats[0]); text != "m" {
+		t.Errorf("a named format should ignore its match rule: %q", text)
+	}
+	if _, err := namedFormat(definitions, "broken"); err == nil {
+		t.Errorf("a broken format should fail")
+	}
+	if _, err := namedFormat(definitions, "missing"); err == nil {
+		t.Errorf("a missing format should fail")
+	}
+
+	formats, err = adHocFormat("{{.service}}: {{.message}}")
+	if err != nil || formats[0].name != adHocFormatName {
+		t.Fatalf("adHocFormat() = %v, %v", formats, err)
+	}
+	if _, err := adHocFormat("{{.service"); err == nil {
+		t.Errorf("a broken template should fail")
+	}
+}
+
+func TestStructuredOutputs(t *testing.T) {
+	msg := logMessage{id: "AAA", tags: []string{"env:prod"}, fields: map[string]string{
+		"message": `said "hi", then left`, "host": "web 1", "_blue": "\033[94m",
+	}}
+
+	var decoded map[string]interface{}
+	line := formatJson(msg)
+	if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+		t.Fatalf("formatJson() isn't valid JSON: %s - %s", line, err.Error())
+	}
+	if decoded["message"] != `said "hi", then left` || decoded["_blue"] != nil {
+		t.Errorf("formatJson() = %s", line)
+	}
+
+	msg.attrs = map[string]interface{}{"message": "raw", "http": map[string]interface{}{"status_code": int64(502)}}
+	opts := &options{output: outputNdjsonRaw}
+	line = formatStructured(opts, msg)
+	if line != `{"http":{"status_code":502},"id":"AAA","message":"raw","tags":["env:prod"]}` {
+		t.Errorf("ndjson-raw = %s", line)
+	}
+
+	opts = &options{output: outputLogfmt, columns: []string{"host", "message", "id", "missing"}}
+	if line = formatStructured(opts, msg); line != `host="web 1" message="said \"hi\", then left" id=AAA missing=""` {
+		t.Errorf("logfmt = %s", line)
+	}
+}
+
+func TestTableOutputs(t *testing.T) {
+	messages := []logMessage{
+		{id: "AAA", tags: []string{"env:prod", "team:web"}, fields: map[string]string{
+			"host": "web, 1", "message": `said "hi"`}},
+		{id: "BBB", fields: map[string]string{"host": "web\t2", "message": "line one\nline two"}},
+	}
+	columns := []string{"id", "host", "message", "tags"}
+
+	opts := &options{output: outputCsv, columns: columns}
+	out := captureStdout(t, func() {
+		for _, msg := range messages {
+			formatStructured(opts, msg)
+		}
+		finishTable(opts)
+	})
+	want := "id,host,message,tags\n" +
+		"AAA,\"web, 1\",\"said \"\"hi\"\"\",\"env:prod,team:web\"\n" +
+		"BBB,web\t2,\"line one\nline two\",\n"
+	if out != want {
+		t.Errorf("csv = %q", out)
+	}
+
+	opts = &options{output: outputTsv, columns: columns}
+	out = captureStdout(t, func() {
+		for _, msg := range messages {
+			formatStructured(opts, msg)
+		}
+		finishTable(opts)
+	})
+	want = "id\thost\tmessage\ttags\n" +
+		"AAA\tweb, 1\t\"said \"\"hi\"\"\"\tenv:prod,team:web\n" +
+		"BBB\t\"web\t2\"\t\"line one\nline two\"\t\n"
+	if out != want {
+		t.Errorf("tsv = %q", out)
+	}
+
+	// The header row is written even when there are no messages
+	opts = &options{output: outputCsv}
+	out = captureStdout(t, func() { finishTable(opts) })
+	if out != strings.Join(defaultColumns, ",")+"\n" {
+		t.Errorf("empty csv = %q", out)
+	}
+}
+
+func TestJsonScalarUnescapes(t *testing.T) {
+	fields := getJSONSimpleMap([]byte(`{"attributes":{"message":"a \"quoted\" café","count":3}}`), attributesField)
+	if fields["message"] != `a "quoted" café` || fields["count"] != "3" {
+		t.Errorf("getJSONSimpleMap() = %v", fields)
+	}
+}
+
+func TestAttributeTree(t *testing.T) {
+	event := []byte(`{"id":"AAA","attributes":{"timestamp":"2019-10-03T13:22:52.882Z","service":"web",
+		"tags":["env:prod","team:a"],"attributes":{"timestamp":"custom","duration":1.5,"ok":true,
+		"http":{"status_code":502,"method":"GET"},"hosts":["a","b"]}}}`)
+	messages := extractMessagesV2([]byte("[" + string(event) + "]"))
+	if len(messages) != 1 {
+		t.Fatalf("extractMessagesV2() = %v", messages)
+	}
+	attrs := messages[0].attrs
+	http, _ := attrs["http"].(map[string]interface{})
+	if http["status_code"] != int64(502) || attrs["duration"] != 1.5 || attrs["ok"] != true ||
+		attrs["timestamp"] != "2019-10-03T13:22:52.882Z" || len(attrs["hosts"].([]interface{})) != 2 {
+		t.Errorf("attrs = %v", attrs)
+	}
+	if messages[0].fields["http_status_code"] != "502" {
+		t.Errorf("fields = %v", messages[0].fields)
+	}
+
+	formats, err := adHocFormat(`{{if ge .attrs.http.status_code 500}}E{{end}} {{.attrs.http.method}} {{range .attrs.hosts}}{{.}}{{end}} {{.service}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := tryFormat(messages[0], formats[0]); text != "E GET ab web" {
+		t.Errorf("template = %q", text)
+	}
+}
+
+func TestRawEvents(t *testing.T) {
+	messages := extractMessagesV2([]byte(`[ {"id": "AAA",
+		"attributes": {"timestamp": "2019-10-03T13:22:52.882Z", "message": "a \"b\"", "attributes": {"n": 1.50}}} ]`))
+	if len(messages) != 1 {
+		t.Fatalf("extractMessagesV2() = %v", messages)
+	}
+	expected := `{"id":"AAA","attributes":{"timestamp":"2019-10-03T13:22:52.882Z","message":"a \"b\"","attributes":{"n":1.50}}}`
+	if string(messages[0].raw) != expected {
+		t.Errorf("raw = %s", messages[0].raw)
+	}
+}
+
+func TestUseColors(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	tests := []struct {
+		mode     string
+		vars     map[string]string
+		terminal bool
+		expected bool
+	}{
+		{colorAuto, nil, true, true},
+		{colorAuto, nil, false, false},
+		{colorAuto, map[string]string{NoColorEnv: "1"}, true, false},
+		{colorAuto, map[string]string{CliColorEnv: "0"}, true, false},
+		{colorAuto, map[string]string{CliColorEnv: "1"}, true, true},
+		{colorAuto, map[string]string{ForceColorEnv: "1"}, false, true},
+		{colorAuto, map[string]string{ForceColorEnv: "0"}, false, false},
+		{colorAuto, map[string]string{ForceColorEnv: "1", NoColorEnv: "1"}, false, true},
+		{colorAlways, map[string]string{NoColorEnv: "1"}, false, true},
+		{colorNever, map[string]string{ForceColorEnv: "1"}, true, false},
+	}
+	for _, test := range tests {
+		if actual := useColors(test.mode, env(test.vars), test.terminal); actual != test.expected {
+			t.Errorf("useColors(%s, %v, %v) = %v", test.mode, test.vars, test.terminal, actual)
+		}
+	}
+}
+
+func TestParseColorSpec(t *testing.T) {
+	tests := map[string]string{
+		"red":                 "\033[91m",
+		"bold white on red":   "\033[1;97;101m",
+		"underline 208":       "\033[4;38;5;208m",
+		"#ff8800 on #202020":  "\033[38;2;255;136;0;48;2;32;32;32m",
+		"rgb:FF8800":          "\033[38;2;255;136;0m",
+		"  ":                  "",
+		"Bold Reverse Yellow": "\033[1;7;93m",
+	}
+	for spec, expected := range tests {
+		if esc, err := parseColorSpec(spec); err != nil || esc != expected {
+			t.Errorf("parseColorSpec(%q) = %q, %v", spec, esc, err)
+		}
+	}
+	for _, bad := range []string{"sparkly", "256", "#ff88", "ff8800", "red on", "on bold"} {
+		if _, err := parseColorSpec(bad); err == nil {
+			t.Errorf("parseColorSpec(%q) should fail", bad)
+		}
+	}
+}
+
+func TestColorTheme(t *testing.T) {
+	theme := newColorTheme(map[string]string{"error": "bold red", "host": "208", "red": "196", "broken": "sparkly"})
+	if theme.levels[errorLevel] != "\033[1;91m" || theme.levels[infoLevel] != infoEsc {
+		t.Errorf("levels = %q", theme.levels)
+	}
+	if theme.fields["_host"] != "\033[38;5;208m" || theme.fields[redField] != "\033[38;5;196m" ||
+		theme.fields["_error"] != "\033[1;91m" || theme.fields[blueField] != blueEsc {
+		t.Errorf("fields = %q", theme.fields)
+	}
+	if _, ok := theme.fields["_broken"]; ok {
+		t.Errorf("a broken color should be skipped")
+	}
+
+	for _, color := range []bool{true, false} {
+		opts := &options{color: color, theme: theme}
+		msg := logMessage{fields: map[string]string{}}
+		setupColors(opts, errorLevel, msg)
+		if color && (msg.fields[levelColorField] != "\033[1;91m" || msg.fields["_host"] != "\033[38;5;208m") {
+			t.Errorf("colors = %q", msg.fields)
+		}
+		if !color && (msg.fields[levelColorField] != "" || msg.fields["_host"] != "" || msg.fields[resetField] != "") {
+			t.Errorf("no colors = %q", msg.fields)
+		}
+	}
+}
+
+func TestFetchIndexes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != logsIndexesPath || len(r.Header.Get("Content-Type")) > 0 {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"indexes":[{"name":"main","filter":{"query":"*"},"num_retention_days":15,
+			"daily_limit":300000000,"is_rate_limited":false},{"name":"audit","filter":{"query":"source:audit"},
+			"num_retention_days":360}]}`))
+	}))
+	defer server.Close()
+
+	indexes, err := fetchIndexes(stubOptions(t, server, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 2 || indexes[0].Name != "main" || *indexes[0].DailyLimit != 300000000 ||
+		indexes[1].Filter.Query != "source:audit" || indexes[1].NumRetentionDays != 360 || indexes[1].DailyLimit != nil {
+		t.Errorf("fetchIndexes() = %+v", indexes)
+	}
+
+	opts := stubOptions(t, server, "indexes = main, audit\n")
+	opts.indexes = opts.serverConfig.Indexes()
+	if search := newSearchRequest(opts, ""); strings.Join(search.indexes, ",") != "main,audit" {
+		t.Errorf("indexes = %v", search.indexes)
+	}
+}
+
+// Run a function and return what it printed on stdout.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	_ = w.Close()
+	out, _ := ioutil.ReadAll(r)
+	return string(out)
+}
+
+func TestFirstAndLastOrdering(t *testing.T) {
+	// Five messages, m1 oldest, served two per page in the requested order
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request logsSearchRequestV2
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		ids := []int{1, 2, 3, 4, 5}
+		if request.Sort == sortDescV2 {
+			ids = []int{5, 4, 3, 2, 1}
+		}
+		offset := 0
+		if len(request.Page.Cursor) > 0 {
+			offset, _ = strconv.Atoi(request.Page.Cursor)
+		}
+		var events []string
+		for i := offset; i < offset+request.Page.Limit && i < len(ids); i++ {
+			events = append(events, fmt.Sprintf(`{"id":"m%d","attributes":{"timestamp":"2019-10-03T13:22:0%d.000Z","message":"m%d"}}`, ids[i], ids[i], ids[i]))
+		}
+		after := ""
+		if offset+request.Page.Limit < len(ids) {
+			after = strconv.Itoa(offset + request.Page.Limit)
+		}
+		_, _ = fmt.Fprintf(w, `{"data":[%s],"meta":{"page":{"after":"%s"}}}`, strings.Join(events, ","), after)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		maxResults int
+		fromStart  bool
+		sort       string
+		expected   string
+	}{
+		{0, false, sortAsc, "m1 m2 m3 m4 m5"},
+		{0, false, sortDesc, "m5 m4 m3 m2 m1"},
+		{3, true, sortAsc, "m1 m2 m3"},
+		{3, true, sortDesc, "m3 m2 m1"},
+		{3, false, sortAsc, "m3 m4 m5"},
+		{3, false, sortDesc, "m5 m4 m3"},
+	}
+	for _, test := range tests {
+		opts := stubOptions(t, server, "[formats]\nplain = {{._message_text}}\n")
+		opts.limit = 2
+		opts.maxResults = test.maxResults
+		opts.fromStart = test.fromStart
+		opts.sort = test.sort
+		out := captureStdout(t, func() {
+			if _, err := commandListMessages(opts, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if actual := strings.Join(strings.Fields(out), " "); actual != test.expected {
+			t.Errorf("max %d, from start %v, sort %s: %s", test.maxResults, test.fromStart, test.sort, actual)
+		}
+	}
+}
+
+func TestGrepFilter(t *testing.T) {
+	fields := map[string]string{"_message_text": "Timeout calling payments\n\tat Client.call", "http_url": "/api/pay", "_level": "ERROR"}
+	value := func(field string) string { return fields[field] }
+	tests := []struct {
+		include  []string
+		exclude  []string
+		any      bool
+		expected bool
+	}{
+		{[]string{"(?i)timeout"}, nil, false, true},
+		{[]string{"Client\\.call"}, nil, false, true},
+		{[]string{"timeout"}, nil, false, false},
+		{[]string{"Timeout", "@http.url:^/api/"}, nil, false, true},
+		{[]string{"Timeout", "@http.url:^/web/"}, nil, false, false},
+		{[]string{"nothing", "@_level:ERR"}, nil, true, true},
+		{[]string{"nothing", "@_level:WARN"}, nil, true, false},
+		{nil, []string{"@_level:ERROR"}, false, false},
+		{[]string{"Timeout"}, []string{"healthcheck"}, false, true},
+	}
+	for _, test := range tests {
+		filter, err := newGrepFilter(test.include, test.exclude, test.any)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := filter.matches(value); actual != test.expected {
+			t.Errorf("grep %v, grep-v %v, any %v = %v", test.include, test.exclude, test.any, actual)
+		}
+	}
+	if filter, _ := newGrepFilter(nil, nil, false); filter != nil {
+		t.Errorf("no patterns should give no filter")
+	}
+	if _, err := newGrepFilter([]string{"a("}, nil, false); err == nil {
+		t.Errorf("a bad pattern should fail")
+	}
+}
+
+func TestGrepFoundOnlyWhenOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":[{"id":"AAA","attributes":{"timestamp":"2019-10-03T13:22:52.882Z","message":"hello"}}],
+			"meta":{"status":"done"}}`))
+	}))
+	defer server.Close()
+
+	opts := stubOptions(t, server, "[formats]\nplain = {{._message_text}}\n")
+	for pattern, want := range map[string]bool{"hello": true, "goodbye": false} {
+		opts.grep, _ = newGrepFilter([]string{pattern}, nil, false)
+		var found bool
+		captureStdout(t, func() { found, _ = commandListMessages(opts, nil, nil) })
+		if found != want {
+			t.Errorf("--grep %s: found = %v", pattern, found)
+		}
+	}
+}
+
+func TestGrepHighlight(t *testing.T) {
+	filter, _ := newGrepFilter([]string{"pay", "ments"}, nil, false)
+	text := "<web> " + cyanEsc + "calling payments 9" + resetEsc + " done"
+	expected := "<web> " + cyanEsc + "calling " + highlightEsc + "payments" + resetEsc + cyanEsc + " 9" + resetEsc + " done"
+	if actual := filter.highlight(text, highlightEsc); actual != expected {
+		t.Errorf("highlight() = %q", actual)
+	}
+	if actual := filter.highlight(text, ""); actual != text {
+		t.Errorf("highlight() without colors = %q", actual)
+	}
+	// Escape sequences are never highlighted
+	filter, _ = newGrepFilter([]string{"9"}, nil, false)
+	if actual := filter.highlight(text, highlightEsc); strings.Count(actual, highlightEsc) != 1 {
+		t.Errorf("highlight() = %q", actual)
+	}
+}
+
+func TestParseQueryTerms(t *testing.T) {
+	terms := parseQueryTerms(`service:(api OR web) "connection reset" time*out AND -healthcheck NOT @http.status_code:[500 TO 599] @http.url:/api/* status:error *`)
+	var actual []string
+	for _, term := range terms {
+		actual = append(actual, term.field+"="+term.regex.String())
+	}
+	expected := []string{"service=(?i)api", "service=(?i)web", `_message_text=(?i)connection reset`,
+		`_message_text=(?i)time\S*out`, `http_url=(?i)/api/\S*`, "status=(?i)error"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("parseQueryTerms() = %v", actual)
+	}
+
+	// NOT leaves out the term, group or range that follows it
+	terms = parseQueryTerms(`NOT service:api NOT host:(a OR b) -env:(dev OR qa) NOT @duration:[1 TO 5] status:error`)
+	if len(terms) != 1 || terms[0].field != "status" {
+		t.Errorf("parseQueryTerms() = %v", terms)
+	}
+}
+
+func TestQueryTermHighlight(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	opts := stubOptions(t, server, "")
+	opts.queryTerms = parseQueryTerms("timeout msg:payments")
+	msg := logMessage{fields: map[string]string{"_message_text": "Timeout calling payments", "msg": "payments"}}
+	marked := markQueryTerms(opts, msg)
+	if marked.fields["msg"] != termStart+"payments"+termEnd ||
+		marked.fields["_message_text"] != termStart+"Timeout"+termEnd+" calling "+termStart+"payments"+termEnd {
+		t.Errorf("fields = %q", marked.fields)
+	}
+	if msg.fields["msg"] != "payments" {
+		t.Errorf("the message fields should be left untouched: %q", msg.fields)
+	}
+
+	text := cyanEsc + marked.fields["_message_text"] + resetEsc
+	expected := cyanEsc + termEsc + "Timeout" + resetEsc + cyanEsc + " calling " + termEsc + "payments" + resetEsc + cyanEsc + resetEsc
+	if actual := renderQueryTerms(text, termEsc); actual != expected {
+		t.Errorf("renderQueryTerms() = %q", actual)
+	}
+	// A match cut by the template is closed at the end of the line
+	if actual := renderQueryTerms(termStart+"Time", termEsc); actual != termEsc+"Time"+resetEsc {
+		t.Errorf("renderQueryTerms() = %q", actual)
+	}
+}
+
+func TestQueryTermsDontChangeTheFormat(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	opts := stubOptions(t, server, "[formats]\ngw = gw {{.service}} {{if eq .service \"api-gateway\"}}edge{{end}}\n"+
+		"gw.match = service=api-gateway\nother = other {{.service}}\n")
+	opts.formats = compileFormats(opts.serverConfig.Formats())
+	opts.color = true
+	opts.queryTerms = parseQueryTerms("service:api-gateway")
+	msg := logMessage{fields: map[string]string{"service": "api-gateway", termField: termEsc}}
+
+	out := captureStdout(t, func() { printMessage(opts, msg) })
+	if out != "gw "+termEsc+"api-gateway"+resetEsc+" edge\n" {
+		t.Errorf("printMessage() = %q", out)
+	}
+
+	msg.fields["service"] = "web"
+	if out = captureStdout(t, func() { printMessage(opts, msg) }); out != "other web\n" {
+		t.Errorf("printMessage() = %q", out)
+	}
+}
+
+func TestCommandCount(t *testing.T) {
+	var requests []logsAggregateRequestV2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != logsAggregateV2Path {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var request logsAggregateRequestV2
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		if request.Page == nil {
+			_, _ = w.Write([]byte(`{"data":{"buckets":[{"by":{"service":"web","@http.status_code":200},"computes":{"c0":12}},
+				{"by":{"service":"api","@http.status_code":500},"computes":{"c0":3}}]},"meta":{"page":{"after":"next"}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"buckets":[{"by":{"service":"api","@http.status_code":200},"computes":{"c0":40}}]},"meta":{}}`))
+	}))
+	defer server.Close()
+
+	opts := stubOptions(t, server, "")
+	opts.query = "status:error"
+	opts.indexes = []string{"main"}
+	opts.groupBy = []string{"service", "@http.status_code"}
+	opts.facetLimit = DefaultFacetLimit
+
+	opts.output = outputCsv
+	out := captureStdout(t, func() {
+		if code := commandCount(opts, nil); code != 0 {
+			t.Errorf("commandCount() = %d", code)
+		}
+	})
+	if out != "service,@http.status_code,count\napi,200,40\nweb,200,12\napi,500,3\n" {
+		t.Errorf("csv = %q", out)
+	}
+	request := requests[0]
+	if len(requests) != 2 || requests[1].Page.Cursor != "next" || request.Filter.Query != "status:error" ||
+		request.Filter.From != "now-3600s" || request.Filter.Indexes[0] != "main" || len(request.GroupBy) != 2 ||
+		request.GroupBy[1].Facet != "@http.status_code" || request.GroupBy[0].Limit != DefaultFacetLimit ||
+		request.Compute[0].Aggregation != "count" {
+		t.Errorf("requests = %+v", requests)
+	}
+
+	opts.output = outputNdjson
+	out = captureStdout(t, func() { commandCount(opts, nil) })
+	if first := strings.Split(out, "\n")[0]; first != `{"@http.status_code":200,"count":40,"service":"api"}` {
+		t.Errorf("ndjson = %s", first)
+	}
+
+	opts.output = outputText
+	out = captureStdout(t, func() { commandCount(opts, nil) })
+	if lines := strings.Split(out, "\n"); strings.Join(strings.Fields(lines[0]), " ") != "SERVICE @HTTP.STATUS_CODE COUNT" ||
+		strings.Join(strings.Fields(lines[1]), " ") != "api 200 40" {
+		t.Errorf("table = %q", out)
+	}
+}
@@ -2,12 +2,8 @@ package main
 
 import (
 	"./config"
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"github.com/Masterminds/sprig"
 	"strings"
-	"text/template"
 	"time"
 )
 
@@ -20,7 +16,10 @@ const magentaEsc = "\033[95m"
 const cyanEsc = "\033[96m"
 const whiteEsc = "\033[97m"
 
-const resetEsc = "\033[39;49m"
+const resetEsc = "\033[0m"
+
+const highlightEsc = "\033[1;7m"
+const termEsc = "\033[1;4m"
 
 const debugEsc = blueEsc
 const errorEsc = redEsc
@@ -38,37 +37,60 @@ const longTimeFormat = "2006-01-02T15:04:05.000Z"
 
 // Format a log message into JSON.
 func formatJson(msg logMessage) string {
-	var text string
-
-	buf, _ := json.Marshal(msg.fields)
-	text = strings.TrimRight(string(buf), "}")
-	buf, _ = json.Marshal(msg.tags)
-	text += ",\"tags\":"
-	text += string(buf)
-	text += "}"
-
-	text = strings.ReplaceAll(text, "\\\"", "\"")
+	return encodeJson(jsonObject(msg.fields, msg.tags))
+}
 
-	return text
+// Prepare a single log message for output and apply the --grep filters. In raw mode, messages aren't adjusted and
+// the filters apply to the whole event.
+// returns: false if the message is filtered out.
+func keepMessage(opts *options, msg logMessage) bool {
+	if opts.output == outputRaw {
+		return opts.grep == nil || opts.grep.matches(func(string) string { return string(msg.raw) })
+	}
+	adjustMessage(opts, msg)
+	return opts.grep == nil || opts.grep.matches(func(field string) string { return msg.fields[field] })
 }
 
-// Print a single log message
+// Print a single log message, prepared by keepMessage.
 func printMessage(opts *options, msg logMessage) {
-	adjustMessage(opts, msg)
+	// The untouched event, without any computed field
+	if opts.output == outputRaw {
+		fmt.Println(string(msg.raw))
+		return
+	}
+
+	if isStructured(opts) {
+		if text := formatStructured(opts, msg); len(text) > 0 {
+			fmt.Println(text)
+		}
+		return
+	}
 
 	var text string
+	var format *compiledFormat
 
-	if opts.json {
-		text = msg.fields[jsonField]
-	} else {
-		for _, f := range opts.serverConfig.Formats() {
-			text = tryFormat(msg, f.Name, f.Format)
-			if len(text) > 0 {
-				break
-			}
+	for _, f := range messageFormats(opts) {
+		text = tryFormat(msg, f)
+		if len(text) > 0 {
+			format = f
+			break
 		}
 	}
 
+	// Query terms are only highlighted with colors. The format is chosen with the untouched fields, the marked fields
+	// are only rendered with it afterwards. When the template outputs something else with them (e.g., it compares a
+	// field with eq), the matching terms are highlighted wherever they appear in the line instead.
+	if format != nil && opts.color && len(opts.queryTerms) > 0 {
+		if marked, ok := renderFormat(markQueryTerms(opts, msg), format); ok && stripTermMarkers(marked) == text {
+			text = renderQueryTerms(marked, msg.fields[termField])
+		} else {
+			text = highlightLine(text, matchingQueryTerms(opts, msg), msg.fields[termField])
+		}
+	}
+	if len(text) > 0 && opts.grep != nil {
+		text = opts.grep.highlight(text, msg.fields[highlightField])
+	}
+
 	if len(text) > 0 {
 		if strings.HasPrefix(text, config.NoFormatDefined) {
 			fmt.Println("stop")
@@ -81,19 +103,6 @@ func printMessage(opts *options, msg logMessage) {
 	}
 }
 
-// Try to apply a format template.
-// returns: empty string if the format failed.
-func tryFormat(msg logMessage, tmplName string, tmpl string) string {
-	var t = template.Must(template.New(tmplName).Funcs(sprig.TxtFuncMap()).Option("missingkey=error").Parse(tmpl))
-	var result bytes.Buffer
-
-	if err := t.Execute(&result, msg.fields); err == nil {
-		return result.String()
-	}
-
-	return ""
-}
-
 // Convert a timestamp to a long time string.
 func longTime(t time.Time) string {
 	t = t.In(time.Local)
@@ -102,7 +111,6 @@ func longTime(t time.Time) string {
 
 // "Cleanup" the log message and add helper fields.
 func adjustMessage(opts *options, msg logMessage) {
-	isTty := opts.color
 	requestPage := msg.fields[requestPageField]
 	if len(requestPage) > 1 && !strings.HasPrefix(requestPage, "/") {
 		msg.fields[requestPageField] = "/" + requestPage
@@ -120,35 +128,24 @@ func adjustMessage(opts *options, msg logMessage) {
 
 	constructMessageText(opts, msg)
 
-	setupColors(isTty, level, msg)
+	// The structured outputs don't use the color fields
+	if !isStructured(opts) {
+		setupColors(opts, level, msg)
+	}
 }
 
-// Setup the colors in the message structure.
-func setupColors(isTty bool, level string, msg logMessage) {
-	if isTty {
-		computeLevelColor(level, msg)
-		// Add color escapes
-		msg.fields[blueField] = blueEsc
-		msg.fields[redField] = redEsc
-		msg.fields[greenField] = greenEsc
-		msg.fields[yellowField] = yellowEsc
-		msg.fields[greyField] = greyEsc
-		msg.fields[whiteField] = whiteEsc
-		msg.fields[cyanField] = cyanEsc
-		msg.fields[magentaField] = magentaEsc
-		msg.fields[resetField] = resetEsc
-	} else {
-		// Add color escapes
-		msg.fields[blueField] = ""
-		msg.fields[redField] = ""
-		msg.fields[greenField] = ""
-		msg.fields[yellowField] = ""
-		msg.fields[greyField] = ""
-		msg.fields[whiteField] = ""
-		msg.fields[cyanField] = ""
-		msg.fields[magentaField] = ""
-		msg.fields[levelColorField] = ""
-		msg.fields[resetField] = ""
+// Setup the colors in the message structure. Without colors, the color fields are empty.
+func setupColors(opts *options, level string, msg logMessage) {
+	theme := messageTheme(opts)
+	for name, esc := range theme.fields {
+		if !opts.color {
+			esc = ""
+		}
+		msg.fields[name] = esc
+	}
+	msg.fields[levelColorField] = ""
+	if opts.color {
+		msg.fields[levelColorField] = theme.levels[level]
 	}
 }
 
@@ -179,8 +176,6 @@ func constructMessageText(opts *options, msg logMessage) {
 	if len(messageText) == 0 {
 		messageText = msg.fields[jsonField]
 	}
-	// Replace \" with plain "
-	messageText = strings.ReplaceAll(messageText, "\\\"", "\"")
 	msg.fields[messageTextField] = messageText
 }
 
@@ -205,26 +200,6 @@ func normalizeLevel(opts *options, msg logMessage) string {
 	return level
 }
 
-// Compute the color that should be used to display the log level in the message output.
-func computeLevelColor(level string, msg logMessage) {
-	var levelColor string
-	switch level {
-	case debugLevel, traceLevel:
-		levelColor = debugEsc
-	case infoLevel:
-		levelColor = infoEsc
-	case warnLevel:
-		levelColor = warnEsc
-	case errorLevel, fatalLevel:
-		levelColor = errorEsc
-	}
-	if len(levelColor) > 0 {
-		msg.fields[levelColorField] = levelColor
-	} else {
-		msg.fields[levelColorField] = ""
-	}
-}
-
 // Create a shortened version of the Java classname.
 func createShortClassname(classname string) string {
 	parts := strings.Split(classname, ".")
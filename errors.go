@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/buger/jsonparser"
+)
+
+// Kinds of failure when calling Datadog.
+type apiErrorKind int
+
+const (
+	networkError   apiErrorKind = iota // Datadog couldn't be reached or the response couldn't be read
+	authError                          // the keys were rejected (401/403)
+	rateLimitError                     // too many requests (429)
+	serverError                        // Datadog failed (5xx)
+	requestError                       // the request was rejected (other 4xx)
+	malformedError                     // the response isn't the expected JSON
+)
+
+// apiError is returned for every failed call to Datadog.
+type apiError struct {
+	kind    apiErrorKind
+	status  int       // HTTP status code, 0 when no response was received
+	message string    // description of the failure
+	err     error     // underlying error, if any
+	budget  rateLimit // rate limit budget reported with the response
+}
+
+func (e *apiError) Error() string {
+	text := e.message
+	if e.status > 0 {
+		text = fmt.Sprintf("%s (HTTP %d)", text, e.status)
+	}
+	if e.err != nil {
+		text += ": " + e.err.Error()
+	}
+	return text
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// Whether the same call may succeed if it is retried later. A malformed response is usually a one-off, e.g., a
+// truncated body.
+func (e *apiError) temporary() bool {
+	return e.kind == networkError || e.kind == rateLimitError || e.kind == serverError || e.kind == malformedError
+}
+
+// Create the error for a non-2xx response. The body usually contains a json list of error messages.
+func newStatusError(status int, body []byte) *apiError {
+	e := &apiError{status: status, message: "Datadog rejected the request"}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.kind = authError
+		e.message = "Datadog rejected the API or application key"
+	case status == http.StatusTooManyRequests:
+		e.kind = rateLimitError
+		e.message = "Datadog rate limit exceeded"
+	case status >= http.StatusInternalServerError:
+		e.kind = serverError
+		e.message = "Datadog failed to process the request"
+	default:
+		e.kind = requestError
+	}
+	if _, dataType, err := getJSONValue(body, errorsField); err == nil && dataType == jsonparser.Array {
+		e.message += ": " + strings.Join(getJSONArrayOfStrings(body, errorsField), "; ")
+	}
+	return e
+}
+
+// Create the error for a response that isn't the expected JSON.
+func newMalformedError(what string) *apiError {
+	return &apiError{kind: malformedError, message: "Unexpected response from Datadog: " + what}
+}
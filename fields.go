@@ -11,6 +11,10 @@ const messageTextField = "_message_text"
 const jsonField = "_json"
 const shortClassnameField = "_short_classname"
 
+// Template field holding the nested, typed attributes of the message, e.g., {{.attrs.http.status_code}}. It hides a
+// flattened field with the same name.
+const attrsField = "attrs"
+
 // Escape codes
 const levelColorField = "_level_color"
 const blueField = "_blue"
@@ -22,3 +26,5 @@ const whiteField = "_white"
 const cyanField = "_cyan"
 const magentaField = "_magenta"
 const resetField = "_reset"
+const highlightField = "_highlight" // --grep matches
+const termField = "_term"           // query term matches
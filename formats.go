@@ -0,0 +1,128 @@
+package main
+
+import (
+	"./config"
+	"bytes"
+	"fmt"
+	"github.com/Masterminds/sprig"
+	"os"
+	"text/template"
+)
+
+// compiledFormat is a format definition from the config file, parsed once so it can be applied to every message.
+type compiledFormat struct {
+	name     string
+	template *template.Template
+	rule     matchRule // messages the format applies to, empty for all
+	hits     int       // number of messages output with this format
+}
+
+// Name of the format created from --template.
+const adHocFormatName = "_template"
+
+// Parse the format templates. Templates that don't parse are reported on stderr and skipped.
+func compileFormats(definitions []config.FormatDefinition) []*compiledFormat {
+	var formats []*compiledFormat
+	for _, f := range definitions {
+		format, err := compileFormat(f)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping format %s: %s\n", f.Name, err.Error())
+			continue
+		}
+		formats = append(formats, format)
+	}
+	return formats
+}
+
+// Parse a single format template and its match rule.
+func compileFormat(f config.FormatDefinition) (*compiledFormat, error) {
+	t, err := template.New(f.Name).Funcs(sprig.TxtFuncMap()).Option("missingkey=error").Parse(f.Format)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := parseMatchRule(f.Match)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledFormat{name: f.Name, template: t, rule: rule}, nil
+}
+
+// Compile only the named format (--format). Its match rule is ignored, since the format was explicitly asked for.
+func namedFormat(definitions []config.FormatDefinition, name string) ([]*compiledFormat, error) {
+	for _, f := range definitions {
+		if f.Name == name {
+			f.Match = ""
+			format, err := compileFormat(f)
+			if err != nil {
+				return nil, fmt.Errorf("format %s can't be parsed: %s", name, err.Error())
+			}
+			return []*compiledFormat{format}, nil
+		}
+	}
+	return nil, fmt.Errorf("format %s not found, use --list-formats to see the available formats", name)
+}
+
+// Compile a template given on the command-line (--template).
+func adHocFormat(tmpl string) ([]*compiledFormat, error) {
+	format, err := compileFormat(config.FormatDefinition{Name: adHocFormatName, Format: tmpl})
+	if err != nil {
+		return nil, err
+	}
+	return []*compiledFormat{format}, nil
+}
+
+// Get the compiled formats, compiling them on first use.
+func messageFormats(opts *options) []*compiledFormat {
+	if opts.formats == nil {
+		opts.formats = compileFormats(opts.serverConfig.Formats())
+	}
+	return opts.formats
+}
+
+// Try to apply a format template. A format with a match rule only applies to the messages matching the rule.
+// returns: empty string if the format failed.
+func tryFormat(msg logMessage, f *compiledFormat) string {
+	if !f.rule.matches(msg.fields) {
+		return ""
+	}
+	text, ok := renderFormat(msg, f)
+	if ok {
+		f.hits++
+	}
+	return text
+}
+
+// Execute the template of a format, whatever its match rule.
+// returns: false if the template failed.
+func renderFormat(msg logMessage, f *compiledFormat) (string, bool) {
+	var result bytes.Buffer
+	if err := f.template.Execute(&result, templateData(msg)); err != nil {
+		return "", false
+	}
+	return result.String(), true
+}
+
+// Build the value templates are executed with: the flattened fields and, under 'attrs', the attribute tree.
+func templateData(msg logMessage) map[string]interface{} {
+	data := make(map[string]interface{}, len(msg.fields)+1)
+	for name, value := range msg.fields {
+		data[name] = value
+	}
+	attrs := msg.attrs
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+	data[attrsField] = attrs
+	return data
+}
+
+// Print how many messages were output with each format on stderr.
+func printFormatStats(opts *options) {
+	if !opts.stats {
+		return
+	}
+	_, _ = fmt.Fprintln(os.Stderr, "Format hits:")
+	for _, f := range messageFormats(opts) {
+		_, _ = fmt.Fprintf(os.Stderr, "%8d  %s\n", f.hits, f.name)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A '@field:' prefix applies a --grep pattern to a field instead of the message text, e.g., '@http.url:^/api/'.
+var grepFieldRegex = regexp.MustCompile(`^@([\w.-]+):(.*)$`)
+
+// Escape sequences (SGR) in a rendered line.
+var escapeRegex = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// grepPattern is a single --grep or --grep-v regular expression and the field it applies to.
+type grepPattern struct {
+	field string
+	regex *regexp.Regexp
+}
+
+// grepFilter selects the messages to output after they were adjusted: every --grep pattern must match (any of
+// them with --grep-any) and none of the --grep-v patterns may match.
+type grepFilter struct {
+	include []grepPattern
+	exclude []grepPattern
+	any     bool
+}
+
+// Parse a --grep pattern. Patterns apply to the message text (_message_text) unless prefixed with '@<field>:', where
+// the field name uses Datadog's '.' separators or the flattened name, e.g., '@http.status_code:^5' or '@_level:WARN'.
+func parseGrepPattern(expr string) (grepPattern, error) {
+	pattern := grepPattern{field: messageTextField}
+	if groups := grepFieldRegex.FindStringSubmatch(expr); groups != nil {
+		pattern.field = strings.ReplaceAll(groups[1], ".", "_")
+		expr = groups[2]
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return pattern, fmt.Errorf("invalid regular expression '%s': %s", expr, err.Error())
+	}
+	pattern.regex = regex
+	return pattern, nil
+}
+
+// Build the filter of the --grep and --grep-v patterns.
+// returns: nil when there are no patterns.
+func newGrepFilter(include []string, exclude []string, any bool) (*grepFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	filter := &grepFilter{any: any}
+	for _, expr := range include {
+		pattern, err := parseGrepPattern(expr)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, pattern)
+	}
+	for _, expr := range exclude {
+		pattern, err := parseGrepPattern(expr)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, pattern)
+	}
+	return filter, nil
+}
+
+// Whether a message passes the filter. The value function returns the value of a field of the message.
+func (f *grepFilter) matches(value func(field string) string) bool {
+	for _, pattern := range f.exclude {
+		if pattern.regex.MatchString(value(pattern.field)) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		matched := pattern.regex.MatchString(value(pattern.field))
+		if matched && f.any {
+			return true
+		}
+		if !matched && !f.any {
+			return false
+		}
+	}
+	return !f.any
+}
+
+// Highlight the matches of the --grep patterns in a rendered line.
+func (f *grepFilter) highlight(text string, highlightEsc string) string {
+	return highlightLine(text, f.include, highlightEsc)
+}
+
+// Highlight the matches of the patterns in a rendered line.
+func highlightLine(text string, patterns []grepPattern, highlightEsc string) string {
+	if len(patterns) == 0 || len(highlightEsc) == 0 {
+		return text
+	}
+	return mapPlainText(text, func(plain string, restoreEsc string) string {
+		return highlightPlain(plain, patterns, highlightEsc, restoreEsc)
+	})
+}
+
+// Rewrite the text between the escape sequences of a rendered line, the escape sequences are left alone. The rewrite
+// gets the escape sequences that restore the color in effect, so a highlight can be followed by the color before it.
+func mapPlainText(text string, rewrite func(plain string, restoreEsc string) string) string {
+	var result strings.Builder
+	current := ""
+	for len(text) > 0 {
+		plain := text
+		esc := ""
+		if loc := escapeRegex.FindStringIndex(text); loc != nil {
+			plain = text[:loc[0]]
+			esc = text[loc[0]:loc[1]]
+			text = text[loc[1]:]
+		} else {
+			text = ""
+		}
+		result.WriteString(rewrite(plain, resetEsc+current))
+		result.WriteString(esc)
+		if esc == resetEsc {
+			current = ""
+		} else {
+			current += esc
+		}
+	}
+	return result.String()
+}
+
+// Highlight the matches of the patterns in a text without escape sequences, overlapping matches are merged.
+func highlightPlain(text string, patterns []grepPattern, highlightEsc string, restoreEsc string) string {
+	marked := make([]bool, len(text))
+	found := false
+	for _, pattern := range patterns {
+		for _, loc := range pattern.regex.FindAllStringIndex(text, -1) {
+			for i := loc[0]; i < loc[1]; i++ {
+				marked[i] = true
+				found = true
+			}
+		}
+	}
+	if !found {
+		return text
+	}
+	var result strings.Builder
+	for i := 0; i < len(text); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			result.WriteString(highlightEsc)
+		}
+		result.WriteByte(text[i])
+		if marked[i] && (i == len(text)-1 || !marked[i+1]) {
+			result.WriteString(restoreEsc)
+		}
+	}
+	return result.String()
+}
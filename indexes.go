@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const logsIndexesPath = "/api/v1/logs/config/indexes"
+
+// A log index as described by the logs configuration API.
+type logIndex struct {
+	Name             string         `json:"name"`
+	Filter           logIndexFilter `json:"filter"`
+	NumRetentionDays int            `json:"num_retention_days"`
+	DailyLimit       *int64         `json:"daily_limit"`
+	IsRateLimited    bool           `json:"is_rate_limited"`
+}
+
+type logIndexFilter struct {
+	Query string `json:"query"`
+}
+
+type logIndexesResponse struct {
+	Indexes []logIndex `json:"indexes"`
+}
+
+// Fetch the log indexes of the organization, in the order Datadog evaluates them.
+func fetchIndexes(opts *options) ([]logIndex, error) {
+	jsonBytes, err := callDatadog(opts, http.MethodGet, logsIndexesPath, "")
+	if err != nil {
+		return nil, err
+	}
+	var response logIndexesResponse
+	if err := json.Unmarshal(jsonBytes, &response); err != nil || response.Indexes == nil {
+		return nil, newMalformedError("no 'indexes' list")
+	}
+	return response.Indexes, nil
+}
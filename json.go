@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/buger/jsonparser"
 	"os"
@@ -42,7 +44,7 @@ func getJSONArrayOfStrings(data []byte, keys ...string) []string {
 	var stringList []string
 	_, _ = jsonparser.ArrayEach(arraySlice, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
 		if dataType == jsonparser.String || dataType == jsonparser.Number || dataType == jsonparser.Boolean {
-			stringList = append(stringList, Expand(string(value)))
+			stringList = append(stringList, jsonScalar(value, dataType))
 		}
 	})
 	return stringList
@@ -55,6 +57,68 @@ func getJSONSimpleMap(data []byte, keys ...string) map[string]string {
 	return result
 }
 
+// Retrieve a json object from the json buffer as a tree of maps, slices, strings, int64, float64 and bool values.
+// Like the flattened map, the nested 'attributes' object is merged into the top level, reserved fields win over custom
+// attributes of the same name.
+func getJSONTree(data []byte, keys ...string) map[string]interface{} {
+	slice, dataType, err := getJSONValue(data, keys...)
+	if err != nil || dataType != jsonparser.Object {
+		return map[string]interface{}{}
+	}
+	var tree map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(slice))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tree); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to decode object for keys: %v - %s\n", keys, err.Error())
+		return map[string]interface{}{}
+	}
+	result := make(map[string]interface{}, len(tree))
+	if custom, ok := tree[attributesField].(map[string]interface{}); ok {
+		for name, value := range custom {
+			result[name] = typedJSONValue(value)
+		}
+		delete(tree, attributesField)
+	}
+	for name, value := range tree {
+		result[name] = typedJSONValue(value)
+	}
+	return result
+}
+
+// Convert the json.Number values of a decoded tree into int64 (whole numbers) or float64, so templates can compare
+// them with numeric constants, e.g., '{{if ge .attrs.http.status_code 500}}'.
+func typedJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for name, child := range v {
+			v[name] = typedJSONValue(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = typedJSONValue(child)
+		}
+	}
+	return value
+}
+
+// Remove the insignificant whitespace of a json value, so it fits on a single line.
+func compactJSON(data []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// Flatten one level of a json object into the result map, joining nested keys with an underscore. Datadog keeps the
+// custom attributes in a nested 'attributes' object ('content.attributes' in v1, 'attributes.attributes' in v2), that
+// object doesn't count as part of the path.
 func levelPass(data []byte, path string, result map[string]string, keys []string) error {
 	return jsonparser.ObjectEach(data, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
 		skey := string(key)
@@ -62,10 +126,10 @@ func levelPass(data []byte, path string, result map[string]string, keys []string
 			skey = path + "_" + skey
 		}
 		if dataType == jsonparser.String || dataType == jsonparser.Number || dataType == jsonparser.Boolean {
-			result[skey] = Expand(string(value))
+			result[skey] = jsonScalar(value, dataType)
 		} else if dataType == jsonparser.Object {
 			// Don't count 'attributes' as part of the path
-			if skey == "attributes" {
+			if skey == attributesField {
 				skey = ""
 			}
 			err := levelPass(value, skey, result, []string{})
@@ -77,6 +141,16 @@ func levelPass(data []byte, path string, result map[string]string, keys []string
 	}, keys...)
 }
 
+// Convert a json string, number or boolean to a string. Strings are unescaped (\" becomes ", \u00e9 becomes é...).
+func jsonScalar(value []byte, dataType jsonparser.ValueType) string {
+	if dataType == jsonparser.String {
+		if unescaped, err := jsonparser.ParseString(value); err == nil {
+			return Expand(unescaped)
+		}
+	}
+	return Expand(string(value))
+}
+
 // Expand escape strings. JSON strings from Datadog have embedded escape sequences that aren't getting expanded. We
 // have to do it manually.
 func Expand(value string) string {
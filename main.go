@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/briandowns/spinner"
 	"os"
 	"os/signal"
@@ -39,13 +40,16 @@ func delayForSeconds(delay float64) {
 	time.Sleep(time.Duration(delayInMilliseconds) * time.Millisecond)
 }
 
-// Create a new terminal spinner.
+// Create a new terminal spinner. It's disabled when stderr isn't a terminal, so redirected output stays clean.
 func setupSpinner() *spinner.Spinner {
 	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
 	s.UpdateCharSet(spinner.CharSets[21]) // box of dots
 	s.Writer = os.Stderr
 	s.HideCursor = true
 	_ = s.Color("red", "bold")
+	if !isTty(os.Stderr) {
+		s.Disable()
+	}
 	return s
 }
 
@@ -63,13 +67,51 @@ func makeSignalsChannel() chan os.Signal {
 	return c
 }
 
+// Report a failed poll while tailing. The tail carries on unless the tracker gives up on it.
+func reportTailError(s *spinner.Spinner, tracker *tailTracker, err error) {
+	s.Stop()
+	_, _ = fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	if !tracker.failed(err) {
+		os.Exit(1)
+	}
+	s.Start()
+}
+
 func main() {
-	opts := parseArgs()
+	if len(os.Args) > 1 && os.Args[1] == configCommand {
+		os.Exit(commandConfigCheck(parseConfigCheckArgs()))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == indexesCommand {
+		os.Exit(commandListIndexes(parseArgs(indexesCommand, append([]string{os.Args[0]}, os.Args[2:]...))))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == countCommand {
+		os.Exit(commandCount(parseArgs(countCommand, append([]string{os.Args[0]}, os.Args[2:]...)), setupSpinner()))
+	}
+
+	opts := parseArgs("", os.Args)
+
+	if opts.listFormats {
+		commandListFormats(opts)
+		return
+	}
 
 	if !opts.tail {
-		_ = commandListMessages(opts, nil)
+		// The spinner shows the paging progress
+		s := setupSpinner()
+		s.Start()
+		_, err := commandListMessages(opts, s, nil)
+		s.Stop()
+		finishTable(opts)
+		printFormatStats(opts)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
 	} else {
 		var delay = minDelay
+		tracker := newTailTracker(time.Duration(opts.tailOverlap) * time.Second)
 
 		s := setupSpinner()
 		s.Start()
@@ -80,15 +122,22 @@ func main() {
 		go func() {
 			for range exitChan {
 				s.Stop()
+				printFormatStats(opts)
 				os.Exit(0)
 			}
 		}()
 
 		//noinspection GoInfiniteFor
 		for {
-			found := commandListMessages(opts, s)
+			found, err := commandListMessages(opts, s, tracker)
+			if err != nil {
+				reportTailError(s, tracker, err)
+			} else {
+				finishTable(opts)
+			}
 
-			delayForSeconds(delay)
+			// Stretch the delay when the rate limit budget is running low
+			delayForSeconds(rateLimitDelay(delay, lastRateLimit))
 
 			delay = adjustDelay(delay, found)
 		}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Match rule operators.
+const matchEquals = "="
+const matchNotEquals = "!="
+const matchIn = "in"
+const matchNotIn = "not in"
+const matchRegex = "~"
+const matchNotRegex = "!~"
+
+// Conditions of a rule are joined with AND (or &&). Values containing them must be quoted.
+var matchAndRegex = regexp.MustCompile(`(?i)\s+and\b\s*|\s*&&\s*`)
+
+// field in (a, b) / field not in (a, b)
+var matchInRegex = regexp.MustCompile(`(?i)^([@\w.-]+)\s+(not\s+in|in)\s*\((.*)\)$`)
+
+// field=value, field!=value, field~regex, field!~regex
+var matchCompareRegex = regexp.MustCompile(`^([@\w.-]+)\s*(!=|!~|=|~)\s*(.*)$`)
+
+// matchCondition is a single test of a message field.
+type matchCondition struct {
+	field  string
+	op     string
+	values []string
+	regex  *regexp.Regexp
+}
+
+// matchRule selects the messages a format applies to. All conditions must hold.
+type matchRule []matchCondition
+
+// Parse a match rule, e.g., 'service=api-gateway AND _level in (ERROR,FATAL) AND host~^web-'. Field names may use
+// Datadog's '@' prefix and '.' separators, they refer to the flattened fields (e.g., @http.status_code is
+// http_status_code). Values may be double quoted, or back quoted to keep the backslashes of a regex as they are, and
+// must be when they contain AND or &&. An empty expression is an empty rule.
+func parseMatchRule(expr string) (matchRule, error) {
+	var rule matchRule
+	if len(strings.TrimSpace(expr)) == 0 {
+		return rule, nil
+	}
+	for _, part := range splitMatchConditions(strings.TrimSpace(expr)) {
+		part = strings.TrimSpace(part)
+		var condition matchCondition
+		if groups := matchInRegex.FindStringSubmatch(part); groups != nil {
+			condition.field = groups[1]
+			condition.op = strings.Join(strings.Fields(strings.ToLower(groups[2])), " ")
+			for _, value := range splitMatchValues(groups[3]) {
+				condition.values = append(condition.values, unquoteMatchValue(value))
+			}
+		} else if groups := matchCompareRegex.FindStringSubmatch(part); groups != nil {
+			condition.field = groups[1]
+			condition.op = groups[2]
+			condition.values = []string{unquoteMatchValue(groups[3])}
+			if condition.op == matchRegex || condition.op == matchNotRegex {
+				regex, err := regexp.Compile(condition.values[0])
+				if err != nil {
+					return nil, fmt.Errorf("invalid regular expression in '%s': %s", part, err.Error())
+				}
+				condition.regex = regex
+			}
+		} else {
+			return nil, fmt.Errorf("can't parse match condition '%s', expected field=value, field!=value, "+
+				"field in (a,b), field not in (a,b), field~regex or field!~regex", part)
+		}
+		condition.field = strings.ReplaceAll(strings.TrimPrefix(condition.field, "@"), ".", "_")
+		rule = append(rule, condition)
+	}
+	return rule, nil
+}
+
+// Split a rule into its conditions at the ANDs that aren't inside a quoted value.
+func splitMatchConditions(expr string) []string {
+	var parts []string
+	start := 0
+	for _, loc := range matchAndRegex.FindAllStringIndex(expr, -1) {
+		if insideQuotes(expr[:loc[0]]) {
+			continue
+		}
+		parts = append(parts, expr[start:loc[0]])
+		start = loc[1]
+	}
+	return append(parts, expr[start:])
+}
+
+// Split the values of an 'in (...)' list at the commas that aren't inside a quoted value.
+func splitMatchValues(list string) []string {
+	var values []string
+	start := 0
+	for i, c := range list {
+		if c == ',' && !insideQuotes(list[:i]) {
+			values = append(values, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(values, list[start:])
+}
+
+// Whether the end of the text is inside a double or back quoted value.
+func insideQuotes(text string) bool {
+	var quote rune
+	escaped := false
+	for _, c := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '`'):
+			quote = c
+		}
+	}
+	return quote != 0
+}
+
+// Remove the surrounding whitespace and double or back quotes of a value.
+func unquoteMatchValue(value string) string {
+	value = strings.TrimSpace(value)
+	if unquoted, err := strconv.Unquote(value); err == nil && (strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "`")) {
+		return unquoted
+	}
+	return value
+}
+
+// Whether the message fields satisfy every condition of the rule. A missing field only satisfies the negated
+// operators. An empty rule matches everything.
+func (r matchRule) matches(fields map[string]string) bool {
+	for _, condition := range r {
+		value, ok := fields[condition.field]
+		var result bool
+		switch condition.op {
+		case matchEquals, matchNotEquals:
+			result = ok && value == condition.values[0]
+		case matchIn, matchNotIn:
+			for _, v := range condition.values {
+				if ok && value == v {
+					result = true
+					break
+				}
+			}
+		case matchRegex, matchNotRegex:
+			result = ok && condition.regex.MatchString(value)
+		}
+		if condition.op == matchNotEquals || condition.op == matchNotIn || condition.op == matchNotRegex {
+			result = !result
+		}
+		if !result {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output modes (--output).
+const outputText = "text"            // format templates
+const outputNdjson = "ndjson"        // one JSON object per message: all fields, including the computed ones, and tags
+const outputNdjsonRaw = "ndjson-raw" // one JSON object per message: the nested, typed attributes from Datadog, id and tags
+const outputCsv = "csv"              // comma separated columns with a header row
+const outputTsv = "tsv"              // tab separated columns with a header row
+const outputLogfmt = "logfmt"        // key=value pairs
+const outputNdjsonAlias = "json"     // same as ndjson
+const outputRaw = "raw"              // every event exactly as returned by Datadog, one per line
+
+var outputModes = []string{outputText, outputNdjson, outputNdjsonAlias, outputNdjsonRaw, outputCsv, outputTsv, outputLogfmt, outputRaw}
+
+// Columns used by csv, tsv (and logfmt) when no --columns are given.
+var defaultColumns = []string{longTimestampField, "host", "service", computedLevelField, messageTextField}
+
+// Fields that only make sense inside a template. They are left out of the structured outputs.
+var templateOnlyFields = map[string]bool{
+	jsonField: true, levelColorField: true, resetField: true, blueField: true, redField: true, greenField: true,
+	yellowField: true, greyField: true, whiteField: true, cyanField: true, magentaField: true, highlightField: true,
+	termField: true,
+}
+
+// Writes the csv and tsv outputs. The header row is written when the writer is created.
+type tableWriter struct {
+	writer *csv.Writer
+}
+
+// Whether the messages are output in one of the structured modes instead of with the format templates.
+func isStructured(opts *options) bool {
+	return len(opts.output) > 0 && opts.output != outputText
+}
+
+// Encode a value as JSON without escaping HTML characters, which only matter when JSON is embedded in a web page.
+func encodeJson(value interface{}) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value)
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// Build the object written by the JSON outputs: the fields (without the template only ones) and the tags.
+func jsonObject(fields map[string]string, tags []string) map[string]interface{} {
+	object := make(map[string]interface{}, len(fields)+1)
+	for name, value := range fields {
+		if !templateOnlyFields[name] {
+			object[name] = value
+		}
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	object[tagsField] = tags
+	return object
+}
+
+// Format a message for one of the structured output modes.
+// returns: empty string for csv and tsv, which are written directly.
+func formatStructured(opts *options, msg logMessage) string {
+	switch opts.output {
+	case outputNdjsonRaw:
+		object := make(map[string]interface{}, len(msg.attrs)+2)
+		for name, value := range msg.attrs {
+			object[name] = value
+		}
+		object[idField] = msg.id
+		if msg.tags != nil {
+			object[tagsField] = msg.tags
+		}
+		return encodeJson(object)
+	case outputCsv, outputTsv:
+		writeTableRow(opts, msg)
+		return ""
+	case outputLogfmt:
+		return formatLogfmt(opts, msg)
+	default:
+		return encodeJson(jsonObject(msg.fields, msg.tags))
+	}
+}
+
+// Get the csv or tsv writer. It's created, and the header row written, on first use.
+func startTable(opts *options) *tableWriter {
+	if opts.table == nil {
+		writer := csv.NewWriter(os.Stdout)
+		if opts.output == outputTsv {
+			writer.Comma = '\t'
+		}
+		_ = writer.Write(outputColumns(opts))
+		opts.table = &tableWriter{writer: writer}
+	}
+	return opts.table
+}
+
+// Write a csv or tsv row with the --columns of the message.
+func writeTableRow(opts *options, msg logMessage) {
+	table := startTable(opts)
+	columns := outputColumns(opts)
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = columnValue(msg, column)
+	}
+	_ = table.writer.Write(row)
+	table.writer.Flush()
+}
+
+// Finish the csv and tsv outputs. Writes the header row when no message was output, so an empty result is still a
+// table with its columns.
+func finishTable(opts *options) {
+	if opts.output == outputCsv || opts.output == outputTsv {
+		startTable(opts).writer.Flush()
+	}
+}
+
+// Format the message as logfmt. Uses the --columns when given, otherwise every field in name order.
+func formatLogfmt(opts *options, msg logMessage) string {
+	columns := opts.columns
+	if len(columns) == 0 {
+		for name := range msg.fields {
+			if !templateOnlyFields[name] {
+				columns = append(columns, name)
+			}
+		}
+		sort.Strings(columns)
+	}
+	pairs := make([]string, 0, len(columns))
+	for _, column := range columns {
+		pairs = append(pairs, column+"="+logfmtValue(columnValue(msg, column)))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Quote a logfmt value when it is empty or contains spaces, quotes, equal signs or control characters.
+func logfmtValue(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// Get the value of a column, 'tags' and 'id' are the message tags and id.
+func columnValue(msg logMessage, column string) string {
+	switch column {
+	case tagsField:
+		return strings.Join(msg.tags, ",")
+	case idField:
+		return msg.id
+	default:
+		return msg.fields[column]
+	}
+}
+
+// Get the columns of the csv and tsv outputs.
+func outputColumns(opts *options) []string {
+	if len(opts.columns) > 0 {
+		return opts.columns
+	}
+	return defaultColumns
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"./config"
+	"regexp"
+	"strings"
+)
+
+// Markers around the query term matches in field values. Templates only see these, they are turned into escape
+// sequences once the line is rendered, so the color of the surrounding text can be restored after each match.
+const termStart = "\uE000"
+const termEnd = "\uE001"
+
+// A query term: an optional negation, an optional field and a value, which may be a quoted phrase.
+var queryTermRegex = regexp.MustCompile(`([-!]?)(?:(@?[\w.\-]+):)?("(?:[^"\\]|\\.)*"|[^\s()]+)`)
+
+// A range, e.g., '@duration:[100 TO 200]', which can't be highlighted.
+var queryRangeRegex = regexp.MustCompile(`[-!]?@?[\w.\-]+:[\[{][^\]}]*[\]}]`)
+
+// Stands in for a range, so a NOT in front of the range applies to it and not to the next term. Never highlighted.
+const queryRangePlaceholder = " [] "
+
+// A group of values of a field, e.g., 'service:(api OR web)', which may be negated.
+var queryGroupRegex = regexp.MustCompile(`(\bNOT\s+|[-!])?(@?[\w.\-]+):\(([^()]*)\)`)
+
+// Boolean operators of the query syntax.
+var queryOperators = map[string]bool{"AND": true, "OR": true, "NOT": true}
+
+// Extract the terms of a Datadog query that can be highlighted: free text terms match the message text, field:value
+// terms the value of the field. Negated terms (with '-' or NOT), operators, ranges and comparisons are left out.
+// Matching is case insensitive and '*' is a wildcard, like in Datadog.
+func parseQueryTerms(query string) []grepPattern {
+	var terms []grepPattern
+	query = queryRangeRegex.ReplaceAllString(query, queryRangePlaceholder)
+	// service:(api OR web) is service:api OR service:web, a negated group is left out as a whole
+	query = queryGroupRegex.ReplaceAllStringFunc(query, func(group string) string {
+		groups := queryGroupRegex.FindStringSubmatch(group)
+		if len(groups[1]) > 0 {
+			return " "
+		}
+		var expanded []string
+		for _, value := range queryTermRegex.FindAllString(groups[3], -1) {
+			if !queryOperators[value] {
+				expanded = append(expanded, groups[2]+":"+value)
+			}
+		}
+		return " " + strings.Join(expanded, " ") + " "
+	})
+	notNext := false
+	for _, groups := range queryTermRegex.FindAllStringSubmatch(query, -1) {
+		negated, field, value := groups[1], groups[2], groups[3]
+		if len(field) == 0 && value == "NOT" {
+			notNext = true
+			continue
+		}
+		if notNext || len(negated) > 0 || (len(field) == 0 && queryOperators[value]) {
+			notNext = false
+			continue
+		}
+		if strings.HasPrefix(value, "\"") {
+			value = strings.ReplaceAll(strings.Trim(value, "\""), "\\\"", "\"")
+		}
+		if len(strings.Trim(value, "*")) == 0 || strings.ContainsAny(value[:1], "[{<>=") || strings.HasSuffix(value, ":") {
+			continue
+		}
+		parts := strings.Split(value, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		term := grepPattern{field: messageTextField, regex: regexp.MustCompile(`(?i)` + strings.Join(parts, `\S*`))}
+		if len(field) > 0 {
+			term.field = strings.ReplaceAll(strings.TrimPrefix(field, "@"), ".", "_")
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// Mark the matches of the query terms in the fields they apply to. A term on a field that holds the message (see the
+// 'message' and 'full_message' field mappings) also marks the message text.
+// returns: a copy of the message with the marked fields, the fields of the message itself are left untouched.
+func markQueryTerms(opts *options, msg logMessage) logMessage {
+	mappings := opts.serverConfig.Fields()
+	messageFields := append(append([]string{}, mappings[config.MessageField]...), mappings[config.FullMessageField]...)
+	patterns := make(map[string][]grepPattern)
+	for _, term := range opts.queryTerms {
+		patterns[term.field] = append(patterns[term.field], term)
+		for _, name := range messageFields {
+			if term.field == name && term.field != messageTextField {
+				patterns[messageTextField] = append(patterns[messageTextField], term)
+			}
+		}
+	}
+	fields := make(map[string]string, len(msg.fields))
+	for name, value := range msg.fields {
+		fields[name] = value
+	}
+	for field, fieldPatterns := range patterns {
+		if value, ok := fields[field]; ok {
+			fields[field] = highlightPlain(value, fieldPatterns, termStart, termEnd)
+		}
+	}
+	msg.fields = fields
+	return msg
+}
+
+// Get the query terms that match the fields they apply to.
+func matchingQueryTerms(opts *options, msg logMessage) []grepPattern {
+	var terms []grepPattern
+	for _, term := range opts.queryTerms {
+		if term.regex.MatchString(msg.fields[term.field]) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// Remove the query term markers from a rendered line.
+func stripTermMarkers(text string) string {
+	return strings.NewReplacer(termStart, "", termEnd, "").Replace(text)
+}
+
+// Replace the query term markers of a rendered line with the highlight escape sequences. A match cut short by the
+// template is closed at the end of the line.
+func renderQueryTerms(text string, highlightEsc string) string {
+	if !strings.Contains(text, termStart) {
+		return text
+	}
+	open := false
+	text = mapPlainText(text, func(plain string, restoreEsc string) string {
+		var result strings.Builder
+		for {
+			i := strings.IndexAny(plain, termStart+termEnd)
+			if i < 0 {
+				result.WriteString(plain)
+				return result.String()
+			}
+			result.WriteString(plain[:i])
+			plain = plain[i:]
+			if strings.HasPrefix(plain, termStart) {
+				result.WriteString(highlightEsc)
+				open = true
+				plain = plain[len(termStart):]
+			} else {
+				if open {
+					result.WriteString(restoreEsc)
+				}
+				open = false
+				plain = plain[len(termEnd):]
+			}
+		}
+	})
+	if open {
+		text += resetEsc
+	}
+	return text
+}
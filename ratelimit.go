@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Rate limit headers returned by Datadog.
+const rateLimitLimitHeader = "X-RateLimit-Limit"
+const rateLimitRemainingHeader = "X-RateLimit-Remaining"
+const rateLimitResetHeader = "X-RateLimit-Reset"
+const rateLimitPeriodHeader = "X-RateLimit-Period"
+
+// Number of times a rate limited call is retried before giving up.
+const maxRateLimitRetries = 3
+
+// Longest wait before a retry when Datadog didn't say when the budget resets.
+const maxRetryBackoff = 8 * time.Second
+
+// Longest total wait for the retries of a rate limited call.
+const maxRateLimitWait = time.Minute
+
+// Fraction of the rate limit budget below which tailing slows down.
+const lowBudgetFraction = 0.1
+
+// rateLimit is the call budget reported by Datadog for an endpoint.
+type rateLimit struct {
+	known     bool // whether Datadog reported a budget at all
+	limit     int  // calls allowed per period
+	remaining int  // calls left in the current period
+	reset     int  // seconds until the current period ends
+	period    int  // length of a period in seconds
+}
+
+// The budget reported by the most recent call to Datadog.
+var lastRateLimit rateLimit
+
+// Waits before a rate limited call is retried. Replaced in tests.
+var retrySleep = time.Sleep
+
+// Parse the rate limit headers of a response.
+func parseRateLimit(header http.Header) rateLimit {
+	var budget rateLimit
+	var err error
+	if budget.limit, err = strconv.Atoi(header.Get(rateLimitLimitHeader)); err != nil {
+		return rateLimit{}
+	}
+	budget.known = true
+	budget.remaining, _ = strconv.Atoi(header.Get(rateLimitRemainingHeader))
+	budget.reset, _ = strconv.Atoi(header.Get(rateLimitResetHeader))
+	budget.period, _ = strconv.Atoi(header.Get(rateLimitPeriodHeader))
+	return budget
+}
+
+// Whether the remaining budget is running low.
+func (r rateLimit) low() bool {
+	return r.known && float64(r.remaining) < float64(r.limit)*lowBudgetFraction
+}
+
+func (r rateLimit) String() string {
+	if !r.known {
+		return "Rate limit: unknown"
+	}
+	return fmt.Sprintf("Rate limit: %d of %d calls remaining, resets in %ds (period %ds)", r.remaining, r.limit, r.reset, r.period)
+}
+
+// Compute how long to wait before retrying a rate limited call. The budget is the one sent with the rate limited
+// response: waits for it to reset when Datadog said when that happens, otherwise backs off exponentially up to
+// maxRetryBackoff. Up to a second of jitter is added so parallel clients don't retry in lock step.
+func retryDelay(attempt int, budget rateLimit) time.Duration {
+	delay := time.Duration(1<<uint(attempt)) * time.Second
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	if budget.known {
+		delay = time.Duration(budget.reset) * time.Second
+	}
+	return delay + time.Duration(rand.Int63n(int64(time.Second)))
+}
+
+// Slow the tail poll down so the remaining budget lasts until it resets.
+func rateLimitDelay(delay float64, budget rateLimit) float64 {
+	if budget.low() {
+		spread := float64(budget.reset) / float64(budget.remaining+1)
+		if spread > delay {
+			delay = spread
+		}
+	}
+	return delay
+}
+
+// Report the current budget on stderr.
+func reportRateLimit(opts *options) {
+	if opts.verbose {
+		_, _ = fmt.Fprintln(os.Stderr, lastRateLimit.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+)
+
+// Sort directions of a search.
+const sortAsc = "asc"
+const sortDesc = "desc"
+
+// Version independent description of a single log search request. Each API version marshals it into its own body.
+type searchRequest struct {
+	query     string     // Datadog search syntax, '*' when empty
+	timeRange int        // seconds back from now, only used for relative searches
+	start     *time.Time // start of an absolute search
+	end       *time.Time // end of an absolute search
+	sort      string     // sortAsc or sortDesc
+	limit     int        // messages per page
+	cursor    string     // page to fetch, empty for the first page
+	indexes   []string   // indexes to search, empty for the default index
+}
+
+// Create the search request for a page of messages from the command-line options.
+func newSearchRequest(opts *options, cursor string) searchRequest {
+	search := searchRequest{
+		query:     "*",
+		timeRange: opts.timeRange,
+		sort:      fetchOrder(opts),
+		limit:     DefaultLimit,
+		cursor:    cursor,
+		indexes:   opts.indexes,
+	}
+	if opts.startDate != nil && opts.endDate != nil {
+		search.start = opts.startDate
+		search.end = opts.endDate
+	}
+	if opts.limit > 0 {
+		search.limit = opts.limit
+	}
+	if len(opts.query) > 0 {
+		search.query = opts.query
+	}
+	return search
+}
+
+// Get the order of the output, oldest first unless --sort desc was given. Tailing is always oldest first.
+func outputOrder(opts *options) string {
+	if opts.sort == sortDesc && !opts.tail {
+		return sortDesc
+	}
+	return sortAsc
+}
+
+// Get the order in which Datadog returns the messages. When only the first (--first) or last (--last, --max-results)
+// messages are output, the search starts from that end of the time range. Otherwise it's the output order, so pages
+// can be output as they arrive.
+func fetchOrder(opts *options) string {
+	if opts.maxResults > 0 {
+		if opts.fromStart {
+			return sortAsc
+		}
+		return sortDesc
+	}
+	return outputOrder(opts)
+}
+
+// Whether the search is relative to the current moment.
+func (s searchRequest) relative() bool {
+	return s.start == nil || s.end == nil
+}
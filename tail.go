@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Number of polls in a row that may fail before tailing gives up.
+const maxTailFailures = 5
+
+// tailTracker keeps track of what has already been output while tailing. Each poll searches from the high-water mark
+// (the newest timestamp output) minus the overlap window. Messages are ingested with some lag, so the overlap picks up
+// messages that arrived late with an older timestamp; messages ingested later than the overlap are missed. The ids of
+// the messages output within the overlap window are remembered, so messages returned by more than one poll are only
+// output once.
+type tailTracker struct {
+	overlap  time.Duration        // how far back each poll searches from the mark (--tail-overlap)
+	mark     time.Time            // newest message timestamp output, zero before the first message
+	seen     map[string]time.Time // ids output within the overlap window, with their timestamps
+	pollTime time.Time            // when the current poll started
+	failures int                  // polls that failed in a row
+}
+
+// Create a tracker for a new tail.
+func newTailTracker(overlap time.Duration) *tailTracker {
+	return &tailTracker{overlap: overlap, seen: make(map[string]time.Time)}
+}
+
+// Narrow the search of a poll to the part of the timeline that may hold new messages. The first poll only fetches
+// the newest page of the relative range from the command-line, newest first, instead of paging through the whole
+// range. Later polls request results oldest first so they can be output as they are paged.
+// returns: whether the poll stops after the first page.
+func (t *tailTracker) narrow(search *searchRequest) bool {
+	t.pollTime = time.Now()
+	if t.mark.IsZero() {
+		search.sort = sortDesc
+		return true
+	}
+	from := t.mark.Add(-t.overlap)
+	to := t.pollTime
+	search.sort = sortAsc
+	search.start = &from
+	search.end = &to
+	return false
+}
+
+// Drop the messages that were already output and move the high-water mark forward.
+func (t *tailTracker) filter(messages []logMessage) []logMessage {
+	var fresh []logMessage
+	for _, msg := range messages {
+		if _, ok := t.seen[msg.id]; ok {
+			continue
+		}
+		t.seen[msg.id] = msg.timestamp
+		fresh = append(fresh, msg)
+		if msg.timestamp.After(t.mark) {
+			t.mark = msg.timestamp
+		}
+	}
+	return fresh
+}
+
+// Record a failed poll.
+// returns: whether tailing should carry on. A single bad poll (Datadog unreachable or overloaded, a malformed response)
+// is retried, the tail only stops when the failures keep on coming or when retrying can't help (bad keys, a rejected
+// query, missing configuration).
+func (t *tailTracker) failed(err error) bool {
+	var e *apiError
+	if !errors.As(err, &e) || !e.temporary() {
+		return false
+	}
+	t.failures++
+	return t.failures < maxTailFailures
+}
+
+// Finish a successful poll. Forgets the ids that fell out of the overlap window, since no later poll can return them. When
+// nothing was found yet, the next poll starts from the time this one started.
+func (t *tailTracker) done() {
+	t.failures = 0
+	if t.mark.IsZero() {
+		t.mark = t.pollTime
+	}
+	cutoff := t.mark.Add(-t.overlap)
+	for id, ts := range t.seen {
+		if ts.Before(cutoff) {
+			delete(t.seen, id)
+		}
+	}
+}